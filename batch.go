@@ -0,0 +1,81 @@
+package jac
+
+import (
+	"fmt"
+	"time"
+)
+
+// SetMany writes several key/value pairs with a given expiration time t, locking the bucket once.
+//  It marks the key/value pairs persistent if pers is true, in which case they are recorded in the
+//  working file as a single record: after a crash either all or none of them are recovered.
+//  It returns the result of every key: nil, IllegalParameter for an empty key or a nil value, or
+//  RecordDropped when the record could not be passed to the working file writer within LoadDelayMs
+//  (the pair is then set in memory only).
+func (c *Bucket) SetMany(items map[string]interface{}, t time.Duration, pers bool) map[string]error {
+	results := make(map[string]error, len(items))
+	var batch []FileData
+	e := c.bucket.expiration(t)
+	c.bucket.lock()
+	for k, vn := range items {
+		if k == "" || vn == nil {
+			results[k] = IllegalParameter
+			continue
+		}
+		v := anything2String(vn)
+		item := c.bucket.item(v, e)
+		if pers {
+			batch = append(batch, FileData{Op: opSet, Key: k, Value: v, Expiration: e, Version: item.Version})
+		}
+		// items evicted to respect the limits are deleted in the same record
+		for _, x := range c.bucket.shard(k).store(k, item) {
+			batch = append(batch, FileData{Op: opDelete, Key: x, Version: c.bucket.version.Load()})
+		}
+		results[k] = nil
+	}
+	if len(batch) > 0 && !c.send(backupData{op: opBatch, batch: batch}) {
+		c.cache.report(&PersistenceError{Bucket: c.name, Op: opBatch, Err: RecordDropped})
+		if pers {
+			for k, err := range results {
+				if err == nil {
+					results[k] = RecordDropped
+				}
+			}
+		}
+	}
+	c.bucket.unlock()
+	return results
+}
+
+// GetMany reads the values of several keys, locking the bucket once.
+//  Keys without value are missing from the returned map.
+func (c *Bucket) GetMany(keys []string) map[string]string {
+	values := make(map[string]string, len(keys))
+	c.bucket.rlock()
+	for _, k := range keys {
+		if v, found := c.bucket.shard(k).get(k); found {
+			values[k] = fmt.Sprintf("%v", v)
+		}
+	}
+	c.bucket.runlock()
+	return values
+}
+
+// DeleteMany permanently removes several items from the bucket, locking the bucket once.
+//  The deletions are recorded in the working file as a single record.
+//  It returns for every key whether it was in the bucket.
+func (c *Bucket) DeleteMany(keys []string) map[string]bool {
+	results := make(map[string]bool, len(keys))
+	batch := make([]FileData, 0, len(keys))
+	c.bucket.lock()
+	version := c.bucket.version.Load()
+	for _, k := range keys {
+		_, found := c.bucket.shard(k).remove(k, EventDelete)
+		results[k] = found
+		batch = append(batch, FileData{Op: opDelete, Key: k, Version: version})
+	}
+	if len(batch) > 0 && !c.send(backupData{op: opBatch, batch: batch}) {
+		c.cache.report(&PersistenceError{Bucket: c.name, Op: opBatch, Err: RecordDropped})
+	}
+	c.bucket.unlock()
+	return results
+}
@@ -1,103 +1,300 @@
 package jac
 
 import (
+	"fmt"
+	"hash/maphash"
 	"runtime"
 	"time"
 )
 
 // back-end methods
 
-// Return a declare bucketInternal with a given default expiration duration and cleanup
-// interval. If the expiration duration is less than one (or NoExpiration),
+// Return a declare bucketInternal with a given default expiration duration, cleanup
+// interval and number of shards. If the expiration duration is less than one (or NoExpiration),
 // the items in the bucketInternal never expire (by default), and must be deleted
 // manually. If the cleanup interval is less than one, expired items are not
 // deleted from the bucketInternal before calling c.deleteExpired().
-func declare(defaultExpiration, cleanupInterval time.Duration) *bucketInternalPtr {
-	items := make(map[string]Item)
-	return newCacheWithJanitor(defaultExpiration, cleanupInterval, items)
+func declare(defaultExpiration, cleanupInterval time.Duration, shards int) *bucketInternalPtr {
+	if shards < 1 {
+		shards = 1
+	}
+	return newCacheWithJanitor(defaultExpiration, cleanupInterval, shards)
 }
 
-func (c *bucketInternal) set(k string, x interface{}, d time.Duration) {
-	var e int64
-	if d == DefaultExpiration {
-		d = c.defaultExpiration
+// limit bounds the bucket, each shard enforcing its part of the limits with its own policy.
+// The parts add up to the limits, which must not be smaller than the number of shards as a
+// shard with a limit of 0 would have none.
+func (c *bucketInternal) limit(maxItems int, maxBytes int64, policy PolicyFactory) {
+	n := len(c.shards)
+	for i, s := range c.shards {
+		s.maxItems = maxItems / n
+		if i < maxItems%n {
+			s.maxItems++
+		}
+		s.maxBytes = maxBytes / int64(n)
+		if int64(i) < maxBytes%int64(n) {
+			s.maxBytes++
+		}
+		s.policy = policy(s.maxItems)
 	}
-	if d > 0 {
-		e = time.Now().Add(d).UnixNano()
+}
+
+// order keeps a sorted index of the keys
+func (c *bucketInternal) order() {
+	c.index = newSkiplist()
+	for _, s := range c.shards {
+		s.index = c.index
+	}
+}
+
+// shard returns the shard holding k
+func (c *bucketInternal) shard(k string) *shard {
+	if len(c.shards) == 1 {
+		return c.shards[0]
+	}
+	return c.shards[maphash.String(c.seed, k)%uint64(len(c.shards))]
+}
+
+// lock locks all shards, always in the same order, for operations spanning the whole bucket
+func (c *bucketInternal) lock() {
+	for _, s := range c.shards {
+		s.mu.Lock()
+	}
+}
+
+// unlock releases all shards before passing the callbacks collected meanwhile to the workers
+func (c *bucketInternal) unlock() {
+	var pending []notice
+	for _, s := range c.shards {
+		if len(s.pending) > 0 {
+			s.dispatching.Lock()
+			defer s.dispatching.Unlock()
+			pending = append(pending, s.pending...)
+			s.pending = nil
+		}
+	}
+	for _, s := range c.shards {
+		s.mu.Unlock()
+	}
+	if len(pending) > 0 {
+		c.hooks.dispatch(pending)
+	}
+}
+
+// rlock read locks all shards so that iterations see a consistent state of the bucket
+func (c *bucketInternal) rlock() {
+	for _, s := range c.shards {
+		s.mu.RLock()
+	}
+}
+
+func (c *bucketInternal) runlock() {
+	for _, s := range c.shards {
+		s.mu.RUnlock()
 	}
-	c.items[k] = Item{
+}
+
+// item returns a new item with the next version of the bucket. It must be called with the
+// shard of the item locked so that the versions of a key increase in the order of its writes.
+func (c *bucketInternal) item(x interface{}, e int64) Item {
+	return Item{
 		Object:     x,
 		Expiration: e,
+		Version:    c.version.Add(1),
 	}
 }
 
-func (c *bucketInternal) get(k string) (interface{}, bool) {
-	item, found := c.items[k]
-	if !found {
-		return nil, false
+// observe raises the version counter to v, used when loading versioned items
+func (c *bucketInternal) observe(v uint64) {
+	for {
+		current := c.version.Load()
+		if v <= current || c.version.CompareAndSwap(current, v) {
+			return
+		}
+	}
+}
+
+// reset deletes all items. All shards must be locked.
+func (c *bucketInternal) reset() {
+	for _, s := range c.shards {
+		s.reset()
+	}
+	if c.index != nil {
+		c.index.reset()
+	}
+}
+
+// count returns the number of items, including expired ones not yet cleaned up
+func (c *bucketInternal) count() (n int) {
+	c.rlock()
+	for _, s := range c.shards {
+		n += len(s.items)
 	}
-	// "Inlining" of expired
-	if item.Expiration > 0 {
-		if time.Now().UnixNano() > item.Expiration {
-			return nil, false
+	c.runlock()
+	return n
+}
+
+// store writes an item keeping track of the shard size. When the shard limits are exceeded
+// the victims chosen by the eviction policy are removed and returned. s.mu must be held.
+func (s *shard) store(k string, item Item) (evicted []string) {
+	old, found := s.items[k]
+	if found {
+		s.size -= itemSize(k, old)
+	} else if s.index != nil {
+		s.index.insert(k)
+	}
+	s.items[k] = item
+	s.size += itemSize(k, item)
+	if s.hooks.active() {
+		if found {
+			reason := EvictReplaced
+			if old.expired() {
+				reason = EvictExpired
+			}
+			s.notify(k, old, reason)
 		}
+		s.notify(k, item, 0)
 	}
-	return item.Object, true
+	if s.watch.active() {
+		ev := Event{Type: EventSet, Key: k, New: fmt.Sprintf("%v", item.Object), Version: item.Version}
+		if found && !old.expired() {
+			ev.Type = EventUpdate
+			ev.Old = fmt.Sprintf("%v", old.Object)
+		}
+		s.watch.publish(ev)
+	}
+	if s.policy == nil {
+		return nil
+	}
+	s.policy.Add(k)
+	for (s.maxItems > 0 && len(s.items) > s.maxItems) || (s.maxBytes > 0 && s.size > s.maxBytes) {
+		victim, found := s.policy.Victim()
+		if !found {
+			break
+		}
+		if _, found := s.remove(victim, EventEvict); found {
+			evicted = append(evicted, victim)
+		}
+	}
+	return evicted
 }
 
-func (c *bucketInternal) delete(k string) (interface{}, bool) {
-	if c.onEvicted != nil {
-		if v, found := c.items[k]; found {
-			delete(c.items, k)
-			return v.Object, true
+// remove deletes an item keeping track of the shard size, reason is passed to the watchers
+// and callbacks. s.mu must be held.
+func (s *shard) remove(k string, reason EventType) (Item, bool) {
+	item, found := s.items[k]
+	if found {
+		if reason != noEvent && s.watch.active() {
+			s.watch.publish(Event{Type: reason, Key: k, Old: fmt.Sprintf("%v", item.Object), Version: item.Version})
+		}
+		if reason != noEvent && s.hooks.active() {
+			s.notify(k, item, evictReasons[reason])
+		}
+		delete(s.items, k)
+		s.size -= itemSize(k, item)
+		if s.index != nil {
+			s.index.delete(k)
+		}
+		if s.policy != nil {
+			s.policy.Remove(k)
 		}
 	}
-	delete(c.items, k)
-	return nil, false
+	return item, found
 }
 
-func (c *bucketInternal) deleteExpired() {
-	var evictedItems []keyAndValue
-	now := time.Now().UnixNano()
-	c.mu.Lock()
-	for k, v := range c.items {
-		// "Inlining" of expired
-		if v.Expiration > 0 && now > v.Expiration {
-			ov, evicted := c.delete(k)
-			if evicted {
-				evictedItems = append(evictedItems, keyAndValue{k, ov})
-			}
+// reset deletes all items, the index is reset by bucketInternal.reset. s.mu must be held.
+func (s *shard) reset() {
+	if s.watch.active() {
+		for k, item := range s.items {
+			s.watch.publish(Event{Type: EventDelete, Key: k, Old: fmt.Sprintf("%v", item.Object), Version: item.Version})
+		}
+	}
+	if s.hooks.active() {
+		for k, item := range s.items {
+			s.notify(k, item, EvictFlushed)
 		}
 	}
-	c.mu.Unlock()
-	for _, v := range evictedItems {
-		c.onEvicted(v.key, v.value)
+	s.items = map[string]Item{}
+	s.size = 0
+	if s.policy != nil {
+		s.policy.Reset()
+	}
+}
+
+// access records a read for the eviction policy. s.mu must be held, at least for reading.
+func (s *shard) access(k string) {
+	if s.policy != nil {
+		s.policy.Access(k)
 	}
 }
 
-func (c *bucketInternal) bucketItems() map[string]Item {
-	c.mu.RLock()
-	defer c.mu.RUnlock()
-	m := make(map[string]Item, len(c.items))
+func (s *shard) get(k string) (interface{}, bool) {
+	item, found := s.items[k]
+	if !found {
+		return nil, false
+	}
+	if item.expired() {
+		return nil, false
+	}
+	s.access(k)
+	return item.Object, true
+}
+
+// unlock releases s.mu and then passes the callbacks collected meanwhile to the workers.
+// s.dispatching, taken before releasing s.mu, keeps the callbacks in the order of the writes.
+func (s *shard) unlock() {
+	if len(s.pending) == 0 {
+		s.mu.Unlock()
+		return
+	}
+	pending := s.pending
+	s.pending = nil
+	s.dispatching.Lock()
+	defer s.dispatching.Unlock()
+	s.mu.Unlock()
+	s.hooks.dispatch(pending)
+}
+
+// notify collects a callback for key k, run once s.mu is released. s.mu must be held.
+func (s *shard) notify(k string, item Item, reason EvictReason) {
+	s.pending = append(s.pending, notice{key: k, value: fmt.Sprintf("%v", item.Object), reason: reason})
+}
+
+// deleteExpired removes the items of the shard expired for longer than grace
+func (s *shard) deleteExpired(grace time.Duration) {
 	now := time.Now().UnixNano()
-	for k, v := range c.items {
-		// "Inlining" of expired
-		if v.Expiration > 0 {
-			if now > v.Expiration {
-				continue
-			}
+	s.mu.Lock()
+	for k, v := range s.items {
+		if v.expiredAt(now - int64(grace)) {
+			s.remove(k, EventExpire)
 		}
-		m[k] = v
 	}
-	return m
+	s.unlock()
+}
+
+// expiration converts a duration into an absolute expiration time (0 for none)
+func (c *bucketInternal) expiration(d time.Duration) int64 {
+	if d == DefaultExpiration {
+		d = c.defaultExpiration
+	}
+	if d > 0 {
+		return time.Now().Add(d).UnixNano()
+	}
+	return 0
+}
+
+func (c *bucketInternal) deleteExpired() {
+	for _, s := range c.shards {
+		s.deleteExpired(c.stale)
+	}
 }
 
-func (j *janitor) run(c *bucketInternal) {
+func (j *janitor) run(c *bucketInternal, s *shard) {
 	ticker := time.NewTicker(j.Interval)
 	for {
 		select {
 		case <-ticker.C:
-			c.deleteExpired()
+			s.deleteExpired(c.stale)
 		case <-j.stop:
 			ticker.Stop()
 			return
@@ -106,31 +303,56 @@ func (j *janitor) run(c *bucketInternal) {
 }
 
 func stopJanitor(c *bucketInternalPtr) {
-	c.janitor.stop <- true
+	for _, j := range c.janitors {
+		j.stop <- true
+	}
+}
+
+// stop terminates the janitors of a bucket that is being closed
+func (c *bucketInternalPtr) stop() {
+	if c.janitors != nil {
+		runtime.SetFinalizer(c, nil)
+		stopJanitor(c)
+	}
 }
 
+// runJanitor starts a janitor for every shard, their first runs being spread over the interval
 func runJanitor(c *bucketInternal, ci time.Duration) {
-	j := &janitor{
-		Interval: ci,
-		stop:     make(chan bool),
+	for i, s := range c.shards {
+		j := &janitor{
+			Interval: ci,
+			stop:     make(chan bool),
+		}
+		c.janitors = append(c.janitors, j)
+		go func(delay time.Duration) {
+			select {
+			case <-time.After(delay):
+				j.run(c, s)
+			case <-j.stop:
+			}
+		}(ci * time.Duration(i) / time.Duration(len(c.shards)))
 	}
-	c.janitor = j
-	go j.run(c)
 }
 
-func newCache(de time.Duration, m map[string]Item) *bucketInternal {
+func newCache(de time.Duration, shards int) *bucketInternal {
 	if de == 0 {
 		de = -1
 	}
 	c := &bucketInternal{
 		defaultExpiration: de,
-		items:             m,
+		shards:            make([]*shard, shards),
+		seed:              maphash.MakeSeed(),
+		watch:             &watchers{},
+		hooks:             newHooks(1),
+	}
+	for i := range c.shards {
+		c.shards[i] = &shard{items: make(map[string]Item), watch: c.watch, hooks: c.hooks}
 	}
 	return c
 }
 
-func newCacheWithJanitor(de time.Duration, ci time.Duration, m map[string]Item) *bucketInternalPtr {
-	c := newCache(de, m)
+func newCacheWithJanitor(de time.Duration, ci time.Duration, shards int) *bucketInternalPtr {
+	c := newCache(de, shards)
 	// This trick ensures that the janitor goroutine (which--granted it
 	// was enabled--is running deleteExpired on c forever) does not keep
 	// the returned C object from being garbage collected. When it is
@@ -144,27 +366,119 @@ func newCacheWithJanitor(de time.Duration, ci time.Duration, m map[string]Item)
 	return C
 }
 
+// itemSize is the number of bytes accounted to an item for MaxBytes
+func itemSize(k string, item Item) int64 {
+	if v, ok := item.Object.(string); ok {
+		return int64(len(k) + len(v))
+	}
+	return int64(len(k) + len(anything2String(item.Object)))
+}
+
 func (item Item) expired() bool {
-	if item.Expiration == 0 {
+	return item.expiredAt(time.Now().UnixNano())
+}
+
+// expiredAt reports whether the item has expired at now (nanoseconds), items without expiration
+// time never expire
+func (item Item) expiredAt(now int64) bool {
+	return item.Expiration != 0 && now > item.Expiration
+}
+
+// set stores a string value in shard s of k, which must be locked
+func (c *Bucket) set(s *shard, k, v string, t time.Duration, bck bool) {
+	if k == "" {
+		return
+	}
+	item := c.bucket.item(v, c.bucket.expiration(t))
+	if bck {
+		c.journal(opSet, k, v, item.Expiration, item.Version)
+	}
+	c.put(s, k, item)
+}
+
+// put stores an item, those evicted to respect the bucket limits are journaled as deleted so
+// that they are not brought back by a crash. s.mu must be held for the shard s of k.
+func (c *Bucket) put(s *shard, k string, item Item) {
+	for _, victim := range s.store(k, item) {
+		c.journal(opDelete, victim, "", 0, 0)
+	}
+}
+
+// journal sends an operation record to the working file writer, dropped records are reported.
+// Records of deletions get the current version so that it is not given again after a restart.
+func (c *Bucket) journal(op, k, v string, e int64, ver uint64) {
+	if op == opDelete {
+		ver = c.bucket.version.Load()
+	}
+	if !c.send(backupData{
+		op:   op,
+		data: [2]string{k, v},
+		exp:  e,
+		ver:  ver,
+	}) {
+		c.cache.report(&PersistenceError{Bucket: c.name, Op: op, Key: k, Err: RecordDropped})
+	}
+}
+
+// send passes a record to the working file writer, it returns false if the record was dropped
+func (c *Bucket) send(rec backupData) bool {
+	if c.cache == nil {
+		return false
+	}
+	rec.file = c.file
+	select {
+	case c.cache.writer <- rec:
+		return true
+	case <-time.After(time.Duration(c.cache.options.LoadDelayMs) * time.Millisecond):
 		return false
 	}
-	return time.Now().UnixNano() > item.Expiration
 }
 
-func (c *Bucket) set(k, v string, t time.Duration, bck bool) {
-	if k == "" {
+// replay applies a working file record to the bucket without journaling it again.
+//  Records written before expiration times were stored (no op) are given exp,
+//  records that expired in the meantime remove the key. Records without a version
+//  (written by earlier versions of jac) are given a new one.
+func (c *Bucket) replay(entry FileData, exp time.Duration) {
+	c.bucket.observe(entry.Version)
+	switch entry.Op {
+	case opVersion:
+		return
+	case opBatch, opCommit:
+		for _, r := range entry.Batch {
+			c.replay(r, exp)
+		}
+		return
+	case opFlush:
+		c.bucket.lock()
+		c.bucket.reset()
+		c.bucket.unlock()
 		return
 	}
-	if c.writer != nil && bck {
-		select {
-		case c.writer <- backupData{
-			data: [2]string{k, v},
-			file: c.file,
-		}:
-		//default:
-		case <-time.After(time.Duration(options.LoadDelayMs) * time.Millisecond):
-			//println("lost")
+	if entry.Key == "" {
+		return
+	}
+	s := c.bucket.shard(entry.Key)
+	s.mu.Lock()
+	switch entry.Op {
+	case opDelete:
+		s.remove(entry.Key, noEvent)
+	default:
+		item := Item{
+			Object:     entry.Value,
+			Expiration: entry.Expiration,
+			Version:    entry.Version,
+		}
+		if entry.Op == "" {
+			item.Expiration = c.bucket.expiration(exp)
+		}
+		if item.Version == 0 {
+			item.Version = c.bucket.version.Add(1)
+		}
+		if item.expired() {
+			s.remove(entry.Key, noEvent)
+		} else {
+			s.store(entry.Key, item)
 		}
 	}
-	c.bucket.set(k, v, t)
+	s.unlock()
 }
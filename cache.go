@@ -3,26 +3,71 @@ package jac
 import (
 	"bufio"
 	"encoding/gob"
-	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"sort"
 	"time"
 )
 
-// Initialise prepare the cache for use. It accept two parameters:
+// Initialise prepare the default cache for use. It accept two parameters:
 //  v : set to true for verbose (useful for development purposes)
 //  o : are the database options (see inm types.go for further details)
-func Initialise(v bool, o *Options) error {
+//  Applications needing more than one independently configured cache should use New instead.
+func Initialise(v bool, o *Options) (err error) {
+	defaultCache, err = create(v, o)
+	return
+}
+
+// Terminate closes the default cache, its open buckets and relative processes
+//  (see Cache.Terminate)
+func Terminate() error {
+	if defaultCache == nil {
+		return NotInitialised
+	}
+	return defaultCache.Terminate()
+}
+
+// NewBucket create a new bucket in the default cache (see Cache.NewBucket)
+func NewBucket(name string, exp time.Duration) (Bucket, error) {
+	return NewBucketWithOptions(name, exp, nil)
+}
+
+// NewBucketWithOptions create a new bucket with the given options in the default cache
+//  (see Cache.NewBucketWithOptions)
+func NewBucketWithOptions(name string, exp time.Duration, o *BucketOptions) (Bucket, error) {
+	if defaultCache == nil {
+		return Bucket{}, NotInitialised
+	}
+	c, e := defaultCache.NewBucketWithOptions(name, exp, o)
+	if c == nil {
+		return Bucket{}, e
+	}
+	return *c, e
+}
+
+// New returns a cache with its own options, buckets and working file writer.
+//  o are the cache options (see types.go for further details), nil for the default ones.
+//  As for Initialise, IllegalParameter is not blocking and the returned cache can be used.
+func New(o *Options) (*Cache, error) {
+	v := false
+	if o != nil {
+		v = o.Verbose
+	}
+	return create(v, o)
+}
 
-	verbose = v
+func create(v bool, o *Options) (*Cache, error) {
 	ex, err := os.Executable()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	// set default values
-	options = Options{
+	c := &Cache{verbose: v}
+	c.options = Options{
 		ExpirationTime:     0,
 		IntervalCompacting: 1440 * 60,
 		InternalBuffering:  10,
@@ -30,6 +75,9 @@ func Initialise(v bool, o *Options) error {
 		MaximumAge:         5 * 60,
 		WorkingFolder:      filepath.Dir(ex) + "/",
 		RecoveryFolder:     filepath.Dir(ex) + "/",
+		Durability:         SyncNever,
+		SyncIntervalMs:     100,
+		SyncRecords:        100,
 	}
 	if o != nil {
 		// read users values
@@ -37,155 +85,382 @@ func Initialise(v bool, o *Options) error {
 		// values below a given minimum will be rejected
 		err = IllegalParameter
 		if o.MaximumAge > 0 {
-			options.MaximumAge = o.MaximumAge
+			c.options.MaximumAge = o.MaximumAge
 			err = nil
 		}
 		if o.IntervalCompacting >= 60 {
-			options.IntervalCompacting = o.IntervalCompacting
+			c.options.IntervalCompacting = o.IntervalCompacting
 			err = nil
 		}
 		if o.InternalBuffering >= 10 {
-			options.InternalBuffering = o.InternalBuffering
+			c.options.InternalBuffering = o.InternalBuffering
 			err = nil
 		}
 		if o.LoadDelayMs >= 5 {
-			options.LoadDelayMs = o.LoadDelayMs
+			c.options.LoadDelayMs = o.LoadDelayMs
 			err = nil
 		}
 		if o.ExpirationTime >= 0 {
-			options.ExpirationTime = o.ExpirationTime
+			c.options.ExpirationTime = o.ExpirationTime
+			err = nil
+		}
+		if o.Durability > DefaultDurability && o.Durability <= SyncEveryRecords {
+			c.options.Durability = o.Durability
+			err = nil
+		}
+		if o.SyncIntervalMs > 0 {
+			c.options.SyncIntervalMs = o.SyncIntervalMs
+			err = nil
+		}
+		if o.SyncRecords > 0 {
+			c.options.SyncRecords = o.SyncRecords
 			err = nil
 		}
 		if o.WorkingFolder != "" {
 			if err = os.MkdirAll(o.WorkingFolder, os.ModePerm); err != nil {
-				fmt.Println(err)
-				os.Exit(0)
+				return nil, err
 			}
-			options.WorkingFolder = o.WorkingFolder
-			if options.WorkingFolder != "" && options.WorkingFolder[len(options.WorkingFolder)-1] != '/' {
-				options.WorkingFolder += "/"
+			c.options.WorkingFolder = o.WorkingFolder
+			if c.options.WorkingFolder != "" && c.options.WorkingFolder[len(c.options.WorkingFolder)-1] != '/' {
+				c.options.WorkingFolder += "/"
 			}
 		}
 		if o.RecoveryFolder != "" {
 			if err = os.MkdirAll(o.RecoveryFolder, os.ModePerm); err != nil {
-				fmt.Println(err)
-				os.Exit(0)
+				return nil, err
 			}
-			options.RecoveryFolder = o.RecoveryFolder
-			if options.RecoveryFolder != "" && options.RecoveryFolder[len(options.RecoveryFolder)-1] != '/' {
-				options.RecoveryFolder += "/"
+			c.options.RecoveryFolder = o.RecoveryFolder
+			if c.options.RecoveryFolder != "" && c.options.RecoveryFolder[len(c.options.RecoveryFolder)-1] != '/' {
+				c.options.RecoveryFolder += "/"
 			}
 		}
 	}
+	c.options.Verbose = v
+	if o != nil {
+		c.options.OnError = o.OnError
+	}
 
 	// set internal processes and channels
-	writeChannel = make(chan backupData, options.InternalBuffering)
-	writeRstChannel = make(chan interface{})
-	go writeHandler(nil)
-	return nil
+	c.buckets = make(map[string]*Bucket)
+	c.writer = make(chan backupData, c.options.InternalBuffering)
+	c.rst = make(chan interface{})
+	go c.writeHandler(nil)
+	return c, err
+}
+
+// report passes an error that cannot be returned to the caller to Options.OnError
+func (cc *Cache) report(err error) {
+	if cc.options.OnError != nil {
+		cc.options.OnError(err)
+	} else if cc.verbose {
+		fmt.Println(err)
+	}
+}
+
+// Options returns the options in use by the cache
+func (cc *Cache) Options() Options {
+	return cc.options
+}
+
+// Terminate closes all open buckets, as Close(false) would, and the cache processes.
+//  Buckets that could not be closed properly are reported as BucketError.
+func (cc *Cache) Terminate() error {
+	cc.mu.Lock()
+	buckets := cc.buckets
+	cc.buckets = nil
+	cc.mu.Unlock()
+	if buckets == nil {
+		return nil
+	}
+	names := make([]string, 0, len(buckets))
+	for name := range buckets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var errs []error
+	for _, name := range names {
+		if err := buckets[name].close(false); err != nil {
+			errs = append(errs, &BucketError{Bucket: name, Err: err})
+		}
+	}
+	cc.rst <- nil
+	<-cc.rst
+	return errors.Join(errs...)
+}
+
+// Buckets returns the names of the open buckets in alphabetical order
+func (cc *Cache) Buckets() []string {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	names := make([]string, 0, len(cc.buckets))
+	for name := range cc.buckets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Bucket returns the open bucket with the given name
+func (cc *Cache) Bucket(name string) (*Bucket, bool) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	c, found := cc.buckets[name]
+	return c, found
+}
+
+// Drop closes the bucket with the given name and deletes its working and recovery files
+func (cc *Cache) Drop(name string) error {
+	c, found := cc.Bucket(name)
+	if !found || !cc.unregister(c) {
+		return BucketNotOpen
+	}
+	err := c.shutdown()
+	for _, file := range []string{
+		cc.options.WorkingFolder + name + ".data",
+		cc.options.WorkingFolder + name + ".data.corrupt",
+		cc.options.RecoveryFolder + name + ".rec",
+	} {
+		if e := os.Remove(file); e != nil && !os.IsNotExist(e) && err == nil {
+			err = e
+		}
+	}
+	return err
 }
 
-// Terminate closes the cache and relative processes
-func Terminate() {
-	writeRstChannel <- nil
-	<-writeRstChannel
+// unregister removes c from the open buckets, it returns false if c was not open
+func (cc *Cache) unregister(c *Bucket) bool {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	if open, found := cc.buckets[c.name]; !found || open.bucket != c.bucket {
+		return false
+	}
+	delete(cc.buckets, c.name)
+	return true
 }
 
 // NewBucket create a new bucket in the cache.
 //  If a rec file or a data file are present and are not older than time.Now() - maxage,
-//  they will be loaded in the cache
-func NewBucket(name string, exp time.Duration) (c Bucket, e error) {
-	c.name = name
-	c.writer = writeChannel
-	c.bucket = declare(time.Duration(options.ExpirationTime)*time.Second, time.Duration(2*options.ExpirationTime)*time.Second)
-	c.cr = make(chan interface{})
+//  they will be loaded in the cache. Loaded keys keep their original expiration time and
+//  keys that expired in the meantime are skipped. exp is only used for data files written
+//  by versions of jac that did not store expiration times.
+func (cc *Cache) NewBucket(name string, exp time.Duration) (c *Bucket, e error) {
+	return cc.NewBucketWithOptions(name, exp, nil)
+}
+
+// NewBucketWithOptions performs the same operation as NewBucket for a bucket with options o
+//  (see types.go for further details), nil for none. When limits are given, items are evicted
+//  according to o.Policy to respect them, also while loading the bucket. The limits are split
+//  among the shards, so a shard can evict items while the bucket as a whole is below them:
+//  limits smaller than the number of shards are rejected with IllegalParameter.
+func (cc *Cache) NewBucketWithOptions(name string, exp time.Duration, o *BucketOptions) (c *Bucket, e error) {
+	if o == nil {
+		o = &BucketOptions{}
+	}
+	if o.MaxItems < 0 || o.MaxBytes < 0 || o.Shards < 0 || o.StaleFor < 0 || o.NegativeTTL < 0 || o.CallbackWorkers < 0 {
+		return nil, IllegalParameter
+	}
+	if shards := max(o.Shards, 1); (o.MaxItems > 0 && o.MaxItems < shards) || (o.MaxBytes > 0 && o.MaxBytes < int64(shards)) {
+		return nil, IllegalParameter
+	}
+	c = &Bucket{
+		name:  name,
+		cache: cc,
+		cr:    make(chan interface{}),
+	}
+	cc.mu.Lock()
+	if cc.buckets == nil {
+		cc.mu.Unlock()
+		return nil, NotInitialised
+	}
+	if _, found := cc.buckets[name]; found {
+		cc.mu.Unlock()
+		return nil, BucketAlreadyOpen
+	}
+	c.bucket = declare(time.Duration(cc.options.ExpirationTime)*time.Second, time.Duration(2*cc.options.ExpirationTime)*time.Second, o.Shards)
+	c.bucket.stale = o.StaleFor
+	if o.Ordered {
+		c.bucket.order()
+	}
+	c.loads = newLoadGroup(o.NegativeTTL)
+	if o.CallbackWorkers > 0 {
+		c.bucket.hooks.workers = o.CallbackWorkers
+	}
+	c.bucket.hooks.wait = time.Duration(cc.options.LoadDelayMs) * time.Millisecond
+	c.bucket.hooks.report = func(err error) {
+		cc.report(&BucketError{Bucket: name, Err: err})
+	}
+	if o.MaxItems > 0 || o.MaxBytes > 0 {
+		policy := o.Policy
+		if policy == nil {
+			policy = NewLRU
+		}
+		c.bucket.limit(o.MaxItems, o.MaxBytes, policy)
+	}
+	cc.buckets[name] = c
+	cc.mu.Unlock()
+	recFile := cc.options.RecoveryFolder + name + ".rec"
+	dataFile := cc.options.WorkingFolder + name + ".data"
 	// first check for recovery file from normal termination
-	statInfo, err := os.Stat(options.RecoveryFolder + name + ".rec")
-	if !os.IsNotExist(err) {
-		if (time.Now().Unix() - statInfo.ModTime().Unix()) < options.MaximumAge*60 {
-			c.file, e = os.Create(options.WorkingFolder + name + ".data")
-			if f, err := os.Open(options.RecoveryFolder + name + ".rec"); err == nil {
-				var data map[string]Item
-				dataDecoder := gob.NewDecoder(f)
-				if err = dataDecoder.Decode(&data); err == nil {
+	if statInfo, err := os.Stat(recFile); err == nil {
+		if (time.Now().Unix() - statInfo.ModTime().Unix()) < cc.options.MaximumAge*60 {
+			c.report.Source = recFile
+			if f, err := os.Open(recFile); err == nil {
+				dataDecoder := gob.NewDecoder(bufio.NewReader(f))
+				// the items come in maps ended by an empty one, earlier files hold a single map
+				for chunks := 0; ; chunks++ {
+					var data map[string]Item
+					if err = dataDecoder.Decode(&data); err != nil {
+						if err != io.EOF || chunks == 0 {
+							c.report.Err = err
+						}
+						break
+					}
+					if len(data) == 0 {
+						// the last version given follows the items
+						var version uint64
+						if dataDecoder.Decode(&version) == nil {
+							c.bucket.observe(version)
+						}
+						break
+					}
+					// keys keep their own expiration time, those expired while closed are skipped
 					for i, v := range data {
-						c.Set(i, fmt.Sprintf("%v", v.Object), exp, true)
+						if v.expired() {
+							continue
+						}
+						c.replay(FileData{
+							Op:         opSet,
+							Key:        i,
+							Value:      fmt.Sprintf("%v", v.Object),
+							Expiration: v.Expiration,
+							Version:    v.Version,
+						}, exp)
+						c.report.Recovered++
 					}
-				} else {
-					c.bucket = declare(time.Duration(options.ExpirationTime)*time.Second, time.Duration(2*options.ExpirationTime)*time.Second)
 				}
 				_ = f.Close()
+			} else {
+				c.report.Err = err
 			}
 		}
-		if e = os.Remove(options.RecoveryFolder + name + ".rec"); err != nil {
-			return
+		e = os.Remove(recFile)
+	} else if statInfo, err = os.Stat(dataFile); err == nil && (time.Now().Unix()-statInfo.ModTime().Unix()) < cc.options.MaximumAge*60 {
+		// check for working file remnants from server crash
+		// records are applied in order so that deletions and flushes are honoured
+		c.report = readWorkingFile(dataFile, func(entry FileData) {
+			c.replay(entry, exp)
+		})
+		if c.report.Discarded > 0 {
+			// keep the damaged file for inspection, it is replaced below
+			_ = os.Rename(dataFile, dataFile+".corrupt")
 		}
-		go compactHandler(c)
-		return
 	}
-	// check for working file remnants from server crash
-	statInfo, err = os.Stat(options.WorkingFolder + name + ".data")
-	if !os.IsNotExist(err) {
-		if (time.Now().Unix() - statInfo.ModTime().Unix()) < options.MaximumAge*60 {
-
-			if c.file, err = os.Open(options.WorkingFolder + name + ".data"); err == nil {
-				scanner := bufio.NewScanner(c.file)
-				for scanner.Scan() {
-					var entry FileData
-					if err := json.Unmarshal([]byte(scanner.Text()), &entry); err == nil {
-						c.Update(entry.Key, entry.Value, exp, true)
-					}
-				}
-				_ = c.file.Close()
-			}
-		}
-		go compactHandler(c)
-		return
+	if cc.verbose && c.report.Source != "" {
+		fmt.Printf("bucket %v loaded from %v: %d recovered, %d discarded, error %v\n",
+			name, c.report.Source, c.report.Recovered, c.report.Discarded, c.report.Err)
+	}
+	// the working file is (re)written atomically with the loaded content
+	var err error
+	if c.file, err = newWorkingFile(name, dataFile, c.bucket.bucketInternal); err != nil && e == nil {
+		e = err
 	}
-	c.file, e = os.Create(options.WorkingFolder + name + ".data")
 	go compactHandler(c)
 	return
 }
 
+// Recovery returns the report of how the bucket was loaded from its recovery (.rec) or
+//  working (.data) file when it was created
+func (c *Bucket) Recovery() RecoveryReport {
+	return c.report
+}
+
 // Close closes a bucket storing values in the recovery data
 //  if keep is false the working data file will be deleted
-func (c *Bucket) Close(keep bool) {
-	if f, err := os.Create(options.RecoveryFolder + c.name + ".rec"); err == nil {
-		// serialize the data
-		dataEncoder := gob.NewEncoder(f)
-		err = dataEncoder.Encode(c.bucket.bucketItems())
-		_ = c.file.Close()
-		_ = f.Close()
-		if err == nil {
-			if !keep {
-				_ = os.Remove(options.WorkingFolder + c.name + ".data")
+func (c *Bucket) Close(keep bool) error {
+	if !c.cache.unregister(c) {
+		return BucketNotOpen
+	}
+	return c.close(keep)
+}
+
+func (c *Bucket) close(keep bool) error {
+	// the recovery file is written atomically so that a crash cannot leave a partial snapshot
+	err := writeAtomic(c.cache.options.RecoveryFolder+c.name+".rec", func(f *os.File) error {
+		b := bufio.NewWriter(f)
+		if err := writeRecovery(b, c.bucket.bucketInternal); err != nil {
+			return err
+		}
+		return b.Flush()
+	})
+	if e := c.shutdown(); err == nil {
+		err = e
+	}
+	if err == nil && !keep {
+		err = os.Remove(c.cache.options.WorkingFolder + c.name + ".data")
+	}
+	return err
+}
+
+// writeRecovery writes the items of the bucket to a recovery file in maps of at most chunkItems
+// items, ended by an empty map and followed by the last version given. The bucket is read locked
+// to write a consistent state.
+func writeRecovery(w io.Writer, c *bucketInternal) error {
+	c.rlock()
+	defer c.runlock()
+	enc := gob.NewEncoder(w)
+	chunk := make(map[string]Item, chunkItems)
+	now := time.Now().UnixNano()
+	for _, s := range c.shards {
+		var err error
+		s.visit(now, func(k string, v Item) bool {
+			chunk[k] = v
+			if len(chunk) == chunkItems {
+				err = enc.Encode(chunk)
+				clear(chunk)
 			}
-		} else {
-			_ = os.Remove(options.RecoveryFolder + c.name + ".rec")
+			return err == nil
+		})
+		if err != nil {
+			return err
 		}
-	} else {
-		_ = c.file.Close()
 	}
-	c.file = nil
+	if len(chunk) > 0 {
+		if err := enc.Encode(chunk); err != nil {
+			return err
+		}
+	}
+	if err := enc.Encode(map[string]Item{}); err != nil {
+		return err
+	}
+	return enc.Encode(c.version.Load())
+}
+
+// shutdown closes the working file and stops the bucket processes
+func (c *Bucket) shutdown() error {
+	err := c.file.close()
+	c.bucket.stop()
+	c.bucket.watch.cancelAll()
+	c.bucket.hooks.stop()
 	go func() { c.cr <- nil }()
+	return err
 }
 
 // Get read the value associated to the key k
 //  It also returns false if the key has not value associated to it
 func (c *Bucket) Get(k string) (string, bool) {
-	c.bucket.mu.RLock()
-	item, found := c.bucket.items[k]
+	s := c.bucket.shard(k)
+	s.mu.RLock()
+	item, found := s.items[k]
 	if !found {
-		c.bucket.mu.RUnlock()
+		s.mu.RUnlock()
 		return "", false
 	}
-	if item.Expiration > 0 {
-		if time.Now().UnixNano() > item.Expiration {
-			c.bucket.mu.RUnlock()
-			return "", false
-		}
+	if item.expired() {
+		s.mu.RUnlock()
+		return "", false
 	}
-	c.bucket.mu.RUnlock()
+	s.access(k)
+	s.mu.RUnlock()
 	v := fmt.Sprintf("%v", item.Object)
 	return v, found || v != ""
 }
@@ -193,30 +468,76 @@ func (c *Bucket) Get(k string) (string, bool) {
 // GetWithExpiration performs the same operation as Get but it also returns the
 //  value expiration time
 func (c *Bucket) GetWithExpiration(k string) (string, time.Time, bool) {
-	c.bucket.mu.RLock()
-	item, found := c.bucket.items[k]
+	s := c.bucket.shard(k)
+	s.mu.RLock()
+	item, found := s.items[k]
 	if !found {
-		c.bucket.mu.RUnlock()
+		s.mu.RUnlock()
 		return "", time.Time{}, false
 	}
 
-	if item.Expiration > 0 {
-		if time.Now().UnixNano() > item.Expiration {
-			c.bucket.mu.RUnlock()
-			return "", time.Time{}, false
-		}
+	if item.expired() {
+		s.mu.RUnlock()
+		return "", time.Time{}, false
+	}
 
+	if item.Expiration != 0 {
 		// Return the item and the expiration time
-		c.bucket.mu.RUnlock()
+		s.access(k)
+		s.mu.RUnlock()
 		return fmt.Sprintf("%v", item.Object), time.Unix(0, item.Expiration), true
 	}
 
-	// If expiration <= 0 (i.e. no expiration time set) then return the item
+	// If expiration is 0 (i.e. no expiration time set) then return the item
 	// and a zeroed time.Time
-	c.bucket.mu.RUnlock()
+	s.access(k)
+	s.mu.RUnlock()
 	return fmt.Sprintf("%v", item.Object), time.Time{}, true
 }
 
+// GetWithVersion performs the same operation as Get but it also returns the version of the
+//  value, which is higher after every write of the key
+func (c *Bucket) GetWithVersion(k string) (string, uint64, bool) {
+	s := c.bucket.shard(k)
+	s.mu.RLock()
+	item, found := s.items[k]
+	if !found || item.expired() {
+		s.mu.RUnlock()
+		return "", 0, false
+	}
+	s.access(k)
+	s.mu.RUnlock()
+	return fmt.Sprintf("%v", item.Object), item.Version, true
+}
+
+// CompareAndSwap writes a new key/value pair with a given expiration time t only if the version
+//  of k is still expected, an expected version of 0 requiring k to be missing. It returns the new
+//  version and true when the value has been written, the current version (0 when k is missing)
+//  and false otherwise. It marks the key/value pair persistent if pers is true.
+func (c *Bucket) CompareAndSwap(k string, expected uint64, vn interface{}, t time.Duration, pers bool) (uint64, bool) {
+	if k == "" || vn == nil {
+		return 0, false
+	}
+	v := anything2String(vn)
+	s := c.bucket.shard(k)
+	s.mu.Lock()
+	var current uint64
+	if item, found := s.items[k]; found && !item.expired() {
+		current = item.Version
+	}
+	if current != expected {
+		s.unlock()
+		return current, false
+	}
+	item := c.bucket.item(v, c.bucket.expiration(t))
+	if pers {
+		c.journal(opSet, k, v, item.Expiration, item.Version)
+	}
+	c.put(s, k, item)
+	s.unlock()
+	return item.Version, true
+}
+
 // Set writes a new key/value pair with a given expiration time t and
 //  It marks the key/value pair persistent if pers is true.
 func (c *Bucket) Set(k string, vn interface{}, t time.Duration, pers bool) {
@@ -224,123 +545,187 @@ func (c *Bucket) Set(k string, vn interface{}, t time.Duration, pers bool) {
 		return
 	}
 	v := anything2String(vn)
-	if c.writer != nil && pers {
-		select {
-		case c.writer <- backupData{
-			data: [2]string{k, v},
-			file: c.file,
-		}:
-		case <-time.After(time.Duration(options.LoadDelayMs) * time.Millisecond):
-		}
+	s := c.bucket.shard(k)
+	s.mu.Lock()
+	item := c.bucket.item(v, c.bucket.expiration(t))
+	if pers {
+		c.journal(opSet, k, v, item.Expiration, item.Version)
+	}
+	c.put(s, k, item)
+	s.unlock()
+}
+
+// SetE performs the same operation as Set but it returns IllegalParameter for an empty key or
+//  a nil value and RecordDropped if the persistence record could not be passed to the working
+//  file writer within LoadDelayMs. In the latter case the value is set in memory only.
+//  Errors occurring later while writing the record are passed to Options.OnError.
+func (c *Bucket) SetE(k string, vn interface{}, t time.Duration, pers bool) error {
+	if k == "" || vn == nil {
+		return IllegalParameter
+	}
+	v := anything2String(vn)
+	s := c.bucket.shard(k)
+	s.mu.Lock()
+	item := c.bucket.item(v, c.bucket.expiration(t))
+	sent := !pers || c.send(backupData{
+		op:   opSet,
+		data: [2]string{k, v},
+		exp:  item.Expiration,
+		ver:  item.Version,
+	})
+	c.put(s, k, item)
+	s.unlock()
+	if !sent {
+		return RecordDropped
 	}
+	return nil
+}
 
-	var e int64
-	if t == DefaultExpiration {
-		t = c.bucket.defaultExpiration
+// SetWithDurability writes a new persistent key/value pair with a given expiration time t
+//  using durability d instead of the one given in Options. With SyncEveryWrite it only
+//  returns once the record has been synced to the working file.
+func (c *Bucket) SetWithDurability(k string, vn interface{}, t time.Duration, d Durability) error {
+	if k == "" || vn == nil {
+		return IllegalParameter
 	}
-	if t > 0 {
-		e = time.Now().Add(t).UnixNano()
+	v := anything2String(vn)
+	s := c.bucket.shard(k)
+	s.mu.Lock()
+	item := c.bucket.item(v, c.bucket.expiration(t))
+	rec := backupData{
+		op:   opSet,
+		data: [2]string{k, v},
+		exp:  item.Expiration,
+		ver:  item.Version,
+		sync: d,
+	}
+	if d == SyncEveryWrite {
+		rec.done = make(chan error, 1)
 	}
-	c.bucket.mu.Lock()
-	c.bucket.items[k] = Item{
-		Object:     v,
-		Expiration: e,
+	sent := c.send(rec)
+	c.put(s, k, item)
+	s.unlock()
+	if !sent {
+		return RecordDropped
 	}
-	c.bucket.mu.Unlock()
+	if rec.done != nil {
+		return <-rec.done
+	}
+	return nil
 }
 
 // Update updates the key/value pair with a given expiration time t and
 //  It marks the key/value pair persistent if pers is true. The working file is not changed
 //  even if pers is true
 func (c *Bucket) Update(k string, vn interface{}, t time.Duration, pers bool) {
-	c.bucket.mu.Lock()
 	if k == "" || vn == nil {
 		return
 	}
 	v := anything2String(vn)
-	if _, found := c.bucket.get(k); found {
-		c.bucket.set(k, v, t)
+	s := c.bucket.shard(k)
+	s.mu.Lock()
+	if _, found := s.get(k); found {
+		c.put(s, k, c.bucket.item(v, c.bucket.expiration(t)))
 	} else {
-		c.set(k, v, t, pers)
+		c.set(s, k, v, t, pers)
 	}
-	c.bucket.mu.Unlock()
+	s.unlock()
 }
 
 // Replace replaces an existing key/value pair only it already existing.
 //  It marks the key/value pair persistent if pers is true.
 func (c *Bucket) Replace(k string, vn interface{}, t time.Duration, pers bool) {
-	c.bucket.mu.Lock()
 	if k == "" || vn == nil {
 		return
 	}
 	v := anything2String(vn)
-	if _, found := c.bucket.get(k); found {
-		c.set(k, v, t, pers)
+	s := c.bucket.shard(k)
+	s.mu.Lock()
+	if _, found := s.get(k); found {
+		c.set(s, k, v, t, pers)
 	}
-	c.bucket.mu.Unlock()
+	s.unlock()
 }
 
 // Add add a new key/value pair only if it does not already
 //  It marks the key/value pair persistent if pers is true.
 func (c *Bucket) Add(k string, vn interface{}, t time.Duration, pers bool) (string, bool) {
-	c.bucket.mu.Lock()
-	defer c.bucket.mu.Unlock()
 	if k == "" || vn == nil {
 		return "", false
 	}
 	v := anything2String(vn)
-	if val, found := c.bucket.get(k); found && val != "" {
+	s := c.bucket.shard(k)
+	s.mu.Lock()
+	if val, found := s.get(k); found && val != "" {
+		s.unlock()
 		return fmt.Sprintf("%v", val), true
-	} else {
-		c.set(k, v, t, pers)
-		return "", false
 	}
+	c.set(s, k, v, t, pers)
+	s.unlock()
+	return "", false
 }
 
 // FunctionUpdate updates the new key/value with a custom function of type
 //  func(k, v string) (string, string). The function is given the actual key/value pair is present
 //  and key/"" otherwise and it expects a new key/value pair.
-//  if the function modofies the key, the old key/pair is deleted.
+//  if the function modofies the key, the old key/pair is deleted. When the bucket has several
+//  shards and the new key belongs to another shard, the new key is written after the old one
+//  has been deleted rather than atomically.
 //  It marks the key/value pair persistent if pers is true.
 func (c *Bucket) FunctionUpdate(k string, f updateFunc, t time.Duration, pers bool) (string, string, bool) {
-	c.bucket.mu.Lock()
-	defer c.bucket.mu.Unlock()
 	if k == "" {
 		return "", "", false
 	}
-	if val, found := c.bucket.get(k); found && val != nil {
-		newK, newV := f(k, fmt.Sprintf("%v", val))
+	s := c.bucket.shard(k)
+	s.mu.Lock()
+	// s is the shard of the new key once f has returned, released even if f panics
+	defer func() { s.unlock() }()
+	val, found := s.get(k)
+	found = found && val != nil
+	var newK, newV string
+	if found {
+		newK, newV = f(k, fmt.Sprintf("%v", val))
 		if newK != k {
-			c.bucket.delete(k)
+			s.remove(k, EventDelete)
+			c.journal(opDelete, k, "", 0, 0)
 		}
-		c.set(newK, newV, t, pers)
-		return newK, newV, true
 	} else {
-		newK, newV := f(k, "")
-		c.set(newK, newV, t, pers)
-		return newK, newV, false
+		newK, newV = f(k, "")
 	}
+	if ns := c.bucket.shard(newK); ns != s {
+		s.unlock()
+		s = ns
+		s.mu.Lock()
+	}
+	c.set(s, newK, newV, t, pers)
+	return newK, newV, found
 }
 
 // Items returns all elements in the bucket as a map[string]string
 func (c *Bucket) Items() (rt map[string]string) {
 	rt = make(map[string]string)
-	for i, v := range c.bucket.bucketItems() {
-		if val := fmt.Sprintf("%v", v.Object); val != "" {
-			rt[i] = val
-		}
+	c.bucket.rlock()
+	defer c.bucket.runlock()
+	now := time.Now().UnixNano()
+	for _, s := range c.bucket.shards {
+		s.visit(now, func(k string, v Item) bool {
+			if val := fmt.Sprintf("%v", v.Object); val != "" {
+				rt[k] = val
+			}
+			return true
+		})
 	}
 	return
 }
 
-// Delete permanently removes an item from the bucket
+// Delete permanently removes an item from the bucket.
+//  The deletion is recorded in the working file so that it survives a crash.
 func (c *Bucket) Delete(k string) {
-	c.bucket.mu.Lock()
-	v, evicted := c.bucket.delete(k)
-	c.bucket.mu.Unlock()
-	if evicted {
-		c.bucket.onEvicted(k, v)
-	}
+	s := c.bucket.shard(k)
+	s.mu.Lock()
+	s.remove(k, EventDelete)
+	c.journal(opDelete, k, "", 0, 0)
+	s.unlock()
 }
 
 // Compact initiate a compation request of the working files.
@@ -348,7 +733,7 @@ func (c *Bucket) Delete(k string) {
 func (c *Bucket) Compact() {
 	c.bucket.deleteExpired()
 	select {
-	case c.writer <- backupData{
+	case c.cache.writer <- backupData{
 		data: [2]string{},
 		c:    c.bucket,
 		file: c.file,
@@ -358,28 +743,40 @@ func (c *Bucket) Compact() {
 }
 
 // Flush deletes all items from the bucket.
+//  The flush is recorded in the working file so that it survives a crash.
 func (c *Bucket) Flush() {
-	c.bucket.mu.Lock()
-	c.bucket.items = map[string]Item{}
-	c.bucket.mu.Unlock()
+	c.bucket.lock()
+	c.bucket.reset()
+	c.journal(opFlush, "", "", 0, 0)
+	c.bucket.unlock()
 }
 
 // ItemCount returns the number of items in the bucket. This may include items that have
 //  expired, but have not yet been cleaned up.
 func (c *Bucket) ItemCount() int {
-	c.bucket.mu.RLock()
-	n := len(c.bucket.items)
-	c.bucket.mu.RUnlock()
-	return n
-}
-
-// OnEvicted sets an (optional) function that is called with the key and value when an
-//  item is evicted from the bucketInternal. (Including when it is deleted manually, but
-//  not when it is overwritten.) Set to nil to disable.
-func (c *Bucket) OnEvicted(f func(string, interface{})) {
-	c.bucket.mu.Lock()
-	c.bucket.onEvicted = f
-	c.bucket.mu.Unlock()
+	return c.bucket.count()
+}
+
+// OnEvicted sets an (optional) function that is called with the key, value and reason when a value
+//  leaves the bucket: deleted, expired, evicted to respect the bucket limits, flushed or replaced by
+//  a new value. Callbacks run outside the bucket lock on BucketOptions.CallbackWorkers goroutines,
+//  those of a key on the same goroutine, each queuing up to 256 callbacks. When a queue stays full
+//  for Options.LoadDelayMs, callbacks are dropped and reported as CallbackDropped to Options.OnError.
+//  Set to nil to disable.
+func (c *Bucket) OnEvicted(f func(k, v string, reason EvictReason)) {
+	c.bucket.hooks.update(func() { c.bucket.hooks.onEvicted = f })
+}
+
+// OnSet sets an (optional) function that is called with the key and value when a value is written,
+//  see OnEvicted. Set to nil to disable.
+func (c *Bucket) OnSet(f func(k, v string)) {
+	c.bucket.hooks.update(func() { c.bucket.hooks.onSet = f })
+}
+
+// OnExpired sets an (optional) function that is called with the key and value when a value is removed
+//  after its expiration time, after the OnEvicted function. See OnEvicted. Set to nil to disable.
+func (c *Bucket) OnExpired(f func(k, v string)) {
+	c.bucket.hooks.update(func() { c.bucket.hooks.onExpired = f })
 }
 
 // DeleteExpired deletes all expired items from the bucketInternal.
@@ -0,0 +1,100 @@
+package jac
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// Increment atomically adds n to the integer value of k and returns the result.
+//  A missing key is created with value n and expiration time t, an existing key keeps its
+//  expiration time. It returns NotNumeric if the value of k is not an integer and Overflow if
+//  the result does not fit in an int64, the value being left unchanged in both cases.
+//  It marks the key/value pair persistent if pers is true.
+func (c *Bucket) Increment(k string, n int64, t time.Duration, pers bool) (int64, error) {
+	return c.add(k, t, pers, func(x int64) (int64, bool) {
+		r := x + n
+		return r, (r > x) == (n > 0)
+	})
+}
+
+// Decrement atomically subtracts n from the integer value of k (see Increment)
+func (c *Bucket) Decrement(k string, n int64, t time.Duration, pers bool) (int64, error) {
+	return c.add(k, t, pers, func(x int64) (int64, bool) {
+		r := x - n
+		return r, (r < x) == (n > 0)
+	})
+}
+
+// add replaces the integer value of k, 0 if missing, with the one returned by f unless f
+// reports an overflow
+func (c *Bucket) add(k string, t time.Duration, pers bool, f func(x int64) (int64, bool)) (int64, error) {
+	var result int64
+	err := c.modify(k, t, pers, func(v string, found bool) (string, error) {
+		var x int64
+		if found {
+			var err error
+			if x, err = strconv.ParseInt(v, 10, 64); err != nil {
+				return "", fmt.Errorf("%w: %q", NotNumeric, v)
+			}
+		}
+		r, ok := f(x)
+		if !ok {
+			return "", fmt.Errorf("%w: %q", Overflow, v)
+		}
+		result = r
+		return strconv.FormatInt(result, 10), nil
+	})
+	return result, err
+}
+
+// IncrementFloat atomically adds n to the floating point value of k and returns the result.
+//  It behaves as Increment, integer values being accepted as well.
+func (c *Bucket) IncrementFloat(k string, n float64, t time.Duration, pers bool) (float64, error) {
+	var result float64
+	err := c.modify(k, t, pers, func(v string, found bool) (string, error) {
+		if found {
+			x, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				return "", fmt.Errorf("%w: %q", NotNumeric, v)
+			}
+			result = x
+		}
+		result += n
+		return strconv.FormatFloat(result, 'g', -1, 64), nil
+	})
+	return result, err
+}
+
+// modify replaces the value of k with the one returned by f while holding the lock of its shard.
+//  f is given the current value and whether k exists. A new key gets expiration time t, an existing
+//  one keeps its own. Nothing is written if f returns an error.
+func (c *Bucket) modify(k string, t time.Duration, pers bool, f func(v string, found bool) (string, error)) error {
+	if k == "" {
+		return IllegalParameter
+	}
+	s := c.bucket.shard(k)
+	s.mu.Lock()
+	old, found := s.items[k]
+	found = found && !old.expired()
+	var v string
+	if found {
+		v = fmt.Sprintf("%v", old.Object)
+	}
+	v, err := f(v, found)
+	if err != nil {
+		s.mu.Unlock()
+		return err
+	}
+	e := old.Expiration
+	if !found {
+		e = c.bucket.expiration(t)
+	}
+	item := c.bucket.item(v, e)
+	if pers {
+		c.journal(opSet, k, v, item.Expiration, item.Version)
+	}
+	c.put(s, k, item)
+	s.unlock()
+	return nil
+}
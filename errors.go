@@ -3,5 +3,51 @@ package jac
 import "errors"
 
 var (
-	IllegalParameter = errors.New("illegal parameter given")
+	IllegalParameter  = errors.New("illegal parameter given")
+	RecordDropped     = errors.New("persistence record dropped")
+	CorruptRecord     = errors.New("corrupt record")
+	UnsupportedFormat = errors.New("unsupported file format")
+	NotInitialised    = errors.New("cache not initialised")
+	BucketAlreadyOpen = errors.New("bucket already open")
+	BucketNotOpen     = errors.New("bucket not open")
+	LoaderPanic       = errors.New("loader panicked")
+	NotNumeric        = errors.New("value is not a number")
+	Overflow          = errors.New("integer overflow")
+	CallbackDropped   = errors.New("callback dropped")
 )
+
+// BucketError reports an error that occurred on a given bucket
+type BucketError struct {
+	Bucket string
+	Err    error
+}
+
+func (e *BucketError) Error() string {
+	return "bucket " + e.Bucket + ": " + e.Err.Error()
+}
+
+func (e *BucketError) Unwrap() error {
+	return e.Err
+}
+
+// PersistenceError reports a failure to keep the working file of a bucket up to date:
+// a record dropped because the writer was busy (RecordDropped) or an I/O or encoding failure.
+// These errors are passed to Options.OnError.
+type PersistenceError struct {
+	Bucket string
+	Op     string // operation of the record (set, delete, flush, sync or compact)
+	Key    string
+	Err    error
+}
+
+func (e *PersistenceError) Error() string {
+	msg := "bucket " + e.Bucket + ": " + e.Op
+	if e.Key != "" {
+		msg += " " + e.Key
+	}
+	return msg + ": " + e.Err.Error()
+}
+
+func (e *PersistenceError) Unwrap() error {
+	return e.Err
+}
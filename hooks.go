@@ -0,0 +1,202 @@
+package jac
+
+import (
+	"fmt"
+	"hash/maphash"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// EvictReason tells why a value has left the bucket
+type EvictReason int
+
+const (
+	// Deleted by Delete, DeleteMany, FunctionUpdate or a transaction
+	EvictDeleted EvictReason = iota + 1
+	// Removed after its expiration time
+	EvictExpired
+	// Evicted to respect the bucket limits
+	EvictCapacity
+	// Deleted by Flush
+	EvictFlushed
+	// Overwritten by a new value
+	EvictReplaced
+)
+
+func (r EvictReason) String() string {
+	switch r {
+	case EvictDeleted:
+		return "deleted"
+	case EvictExpired:
+		return "expired"
+	case EvictCapacity:
+		return "capacity"
+	case EvictFlushed:
+		return "flushed"
+	case EvictReplaced:
+		return "replaced"
+	}
+	return "unknown"
+}
+
+// reasons given to OnEvicted for the events of removed items
+var evictReasons = map[EventType]EvictReason{
+	EventDelete: EvictDeleted,
+	EventExpire: EvictExpired,
+	EventEvict:  EvictCapacity,
+}
+
+// hooks holds the callbacks of a bucket and the workers running them, shared by all shards
+type hooks struct {
+	mu        sync.RWMutex
+	onEvicted func(k, v string, reason EvictReason)
+	onSet     func(k, v string)
+	onExpired func(k, v string)
+	set       atomic.Bool // a callback is set, read without lock to skip collecting notices
+	workers   int
+	wait      time.Duration // time given to a worker to make room in its queue before dropping a notice
+	report    func(error)   // receives the CallbackDropped errors, nil to ignore them
+	seed      maphash.Seed
+	queues    []chan notice // one per worker, started with the first callback
+	done      chan struct{} // closed when the bucket is closed
+}
+
+// notice is a callback to run: OnSet when reason is 0, OnEvicted (and OnExpired) otherwise
+type notice struct {
+	key    string
+	value  string
+	reason EvictReason
+}
+
+// kind names the callback of a notice in errors
+func (n notice) kind() string {
+	if n.reason == 0 {
+		return "set"
+	}
+	return n.reason.String()
+}
+
+func newHooks(workers int) *hooks {
+	if workers < 1 {
+		workers = 1
+	}
+	return &hooks{
+		workers: workers,
+		seed:    maphash.MakeSeed(),
+		done:    make(chan struct{}),
+	}
+}
+
+func (h *hooks) active() bool {
+	return h.set.Load()
+}
+
+// update changes the callbacks through f and starts the workers with the first callback
+func (h *hooks) update(f func()) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	f()
+	h.set.Store(h.onEvicted != nil || h.onSet != nil || h.onExpired != nil)
+	if h.queues == nil && h.set.Load() {
+		select {
+		case <-h.done:
+			// the bucket has been closed
+			return
+		default:
+		}
+		h.queues = make([]chan notice, h.workers)
+		for i := range h.queues {
+			h.queues[i] = make(chan notice, callbackQueue)
+			go h.work(h.queues[i])
+		}
+	}
+}
+
+// stop terminates the workers, callbacks not run yet are discarded
+func (h *hooks) stop() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	select {
+	case <-h.done:
+	default:
+		close(h.done)
+	}
+}
+
+// dispatch passes notices to the workers, the notices of a key always to the same worker so that
+// they run in the order in which they are dispatched. It is called without bucket locks: when the
+// queue of a worker is full, it waits up to h.wait for room. Past that, the notice and the next
+// ones that do not fit are dropped and reported as CallbackDropped, so that a stalled callback,
+// or one writing to the bucket from a full queue, never blocks the writers for long.
+func (h *hooks) dispatch(notices []notice) {
+	h.mu.RLock()
+	queues := h.queues
+	h.mu.RUnlock()
+	if queues == nil {
+		return
+	}
+	var timer *time.Timer
+	stalled := false
+	for _, n := range notices {
+		q := queues[maphash.String(h.seed, n.key)%uint64(len(queues))]
+		select {
+		case q <- n:
+			continue
+		default:
+		}
+		if !stalled {
+			if timer == nil {
+				timer = time.NewTimer(h.wait)
+				defer timer.Stop()
+			} else {
+				timer.Reset(h.wait)
+			}
+			select {
+			case q <- n:
+				continue
+			case <-timer.C:
+				stalled = true
+			case <-h.done:
+				return
+			}
+		}
+		if h.report != nil {
+			h.report(fmt.Errorf("%w: %v of %q", CallbackDropped, n.kind(), n.key))
+		}
+	}
+}
+
+func (h *hooks) work(q chan notice) {
+	for {
+		select {
+		case n := <-q:
+			select {
+			case <-h.done:
+				return
+			default:
+			}
+			h.run(n)
+		case <-h.done:
+			return
+		}
+	}
+}
+
+func (h *hooks) run(n notice) {
+	h.mu.RLock()
+	onEvicted, onSet, onExpired := h.onEvicted, h.onSet, h.onExpired
+	h.mu.RUnlock()
+	if n.reason == 0 {
+		if onSet != nil {
+			onSet(n.key, n.value)
+		}
+		return
+	}
+	if onEvicted != nil {
+		onEvicted(n.key, n.value, n.reason)
+	}
+	if n.reason == EvictExpired && onExpired != nil {
+		onExpired(n.key, n.value)
+	}
+}
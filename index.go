@@ -0,0 +1,94 @@
+package jac
+
+import (
+	"math/rand/v2"
+	"sync"
+)
+
+// skiplist is the sorted index of the keys of a bucket (BucketOptions.Ordered). It is shared by
+// all shards: writers hold the lock of the shard of the key, readers hold the lock of all shards.
+type skiplist struct {
+	mu    sync.Mutex // serialises writers of different shards
+	head  skipNode
+	level int
+}
+
+type skipNode struct {
+	key  string
+	next []*skipNode
+}
+
+const (
+	skiplistMaxLevel = 32
+	skiplistP        = 4 // one node in skiplistP goes up a level
+)
+
+func newSkiplist() *skiplist {
+	return &skiplist{
+		head:  skipNode{next: make([]*skipNode, skiplistMaxLevel)},
+		level: 1,
+	}
+}
+
+// path returns the last node before k at every level
+func (l *skiplist) path(k string) (update [skiplistMaxLevel]*skipNode) {
+	x := &l.head
+	for i := l.level - 1; i >= 0; i-- {
+		for x.next[i] != nil && x.next[i].key < k {
+			x = x.next[i]
+		}
+		update[i] = x
+	}
+	return update
+}
+
+func (l *skiplist) insert(k string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	update := l.path(k)
+	if n := update[0].next[0]; n != nil && n.key == k {
+		return
+	}
+	level := 1
+	for level < skiplistMaxLevel && rand.IntN(skiplistP) == 0 {
+		level++
+	}
+	for ; l.level < level; l.level++ {
+		update[l.level] = &l.head
+	}
+	n := &skipNode{key: k, next: make([]*skipNode, level)}
+	for i := 0; i < level; i++ {
+		n.next[i] = update[i].next[i]
+		update[i].next[i] = n
+	}
+}
+
+func (l *skiplist) delete(k string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	update := l.path(k)
+	n := update[0].next[0]
+	if n == nil || n.key != k {
+		return
+	}
+	for i := 0; i < len(n.next); i++ {
+		update[i].next[i] = n.next[i]
+	}
+	for l.level > 1 && l.head.next[l.level-1] == nil {
+		l.level--
+	}
+}
+
+// seek returns the first node with a key not lower than k, nil if there is none
+func (l *skiplist) seek(k string) *skipNode {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.path(k)[0].next[0]
+}
+
+func (l *skiplist) reset() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	clear(l.head.next)
+	l.level = 1
+}
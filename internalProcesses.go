@@ -1,96 +1,121 @@
 package jac
 
 import (
-	"encoding/json"
 	"fmt"
+	"os"
 	"time"
 )
 
 // working file write handler
-func writeHandler(consolidateTimers map[string]int64) {
+func (cc *Cache) writeHandler(consolidateTimers map[string]int64) {
 	defer func() {
 		if r := recover(); r != nil {
-			writeHandler(consolidateTimers)
+			cc.writeHandler(consolidateTimers)
 		}
 	}()
 	if consolidateTimers == nil {
 		consolidateTimers = make(map[string]int64)
 	}
-	if verbose {
+	if cc.verbose {
 		println("start writeHandler")
 	}
+	// working files waiting for a periodic sync (SyncEveryInterval)
+	dirty := make(map[*workingFile]bool)
+	ticker := time.NewTicker(time.Duration(cc.options.SyncIntervalMs) * time.Millisecond)
+	defer ticker.Stop()
 	for {
 		select {
-		case <-writeRstChannel:
-			if verbose {
+		case <-cc.rst:
+			if cc.verbose {
 				fmt.Println("writeHandler closing")
 			}
-			writeRstChannel <- nil
-		case nw := <-writeChannel:
+			for f := range dirty {
+				if err := f.flush(); err != nil {
+					cc.report(&PersistenceError{Bucket: f.bucket, Op: opSync, Err: err})
+				}
+			}
+			cc.rst <- nil
+			return
+		case <-ticker.C:
+			for f := range dirty {
+				if err := f.flush(); err != nil {
+					cc.report(&PersistenceError{Bucket: f.bucket, Op: opSync, Err: err})
+				}
+				delete(dirty, f)
+			}
+		case nw := <-cc.writer:
 			//fmt.Println("received", nw)
 			if nw.file != nil {
 				if nw.c != nil {
-					name := fmt.Sprintf("%v", nw.file.Name())
-					tm, skip := consolidateTimers[name]
+					tm, skip := consolidateTimers[nw.file.path]
 					if skip {
-						skip = time.Now().Unix()-tm < int64(options.IntervalCompacting)
+						skip = time.Now().Unix()-tm < int64(cc.options.IntervalCompacting)
 					} else {
-						consolidateTimers[name] = time.Now().Unix() - 1
+						consolidateTimers[nw.file.path] = time.Now().Unix() - 1
 					}
 					if !skip {
-						// consolidation
-						if e := nw.file.Truncate(0); e == nil {
-							if _, e = nw.file.Seek(0, 0); e == nil {
-								for i, v := range nw.c.bucketItems() {
-									if fmt.Sprintf("%v", v.Object) != "" {
-										if data, err := json.Marshal(FileData{
-											Key:   i,
-											Value: fmt.Sprintf("%v", v.Object),
-										}); err == nil {
-											_, _ = nw.file.WriteString(string(data) + "\n")
-										}
-									}
-								}
+						// consolidation, records keep being written meanwhile
+						go func(f *workingFile, c *bucketInternal) {
+							if err := f.compact(c); err != nil && err != os.ErrClosed {
+								cc.report(&PersistenceError{Bucket: f.bucket, Op: opCompact, Err: err})
 							}
-						}
-						continue
+						}(nw.file, nw.c.bucketInternal)
 					}
+					continue
+				}
+				// Update, delete or flush
+				mode := nw.sync
+				if mode == DefaultDurability {
+					mode = cc.options.Durability
+				}
+				pending, err := nw.file.append(FileData{
+					Op:         nw.op,
+					Key:        nw.data[0],
+					Value:      nw.data[1],
+					Expiration: nw.exp,
+					Version:    nw.ver,
+					Batch:      nw.batch,
+				}, mode, cc.options.SyncRecords)
+				if pending {
+					dirty[nw.file] = true
+				}
+				if err != nil {
+					cc.report(&PersistenceError{Bucket: nw.file.bucket, Op: nw.op, Key: nw.data[0], Err: err})
 				}
-				// Update
-				if data, err := json.Marshal(FileData{
-					Key:   nw.data[0],
-					Value: nw.data[1],
-				}); err == nil {
-					_, _ = nw.file.WriteString(string(data) + "\n")
+				if nw.done != nil {
+					nw.done <- err
 				}
+			} else if nw.done != nil {
+				nw.done <- nil
 			}
 		}
 	}
 }
 
 // working file compact handler
-func compactHandler(c Bucket) {
+func compactHandler(c *Bucket) {
 	defer func() {
 		if r := recover(); r != nil {
 			compactHandler(c)
 		}
 	}()
-	if verbose {
+	if c.cache.verbose {
 		println("start compactHandler for " + c.name)
 	}
 	for {
 		select {
 		case <-c.cr:
-			if verbose {
+			if c.cache.verbose {
 				fmt.Println("compactHandler closing for", c.name)
 			}
-		case <-time.After(time.Duration(options.IntervalCompacting) * time.Second):
+			return
+		case <-time.After(time.Duration(c.cache.options.IntervalCompacting) * time.Second):
 			// in case of a zombie
-			if c.file == nil {
+			if c.file.closed() {
 				return
 			}
 			c.bucket.deleteExpired()
-			c.writer <- backupData{
+			c.cache.writer <- backupData{
 				c:    c.bucket,
 				file: c.file,
 			}
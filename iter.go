@@ -0,0 +1,105 @@
+package jac
+
+import (
+	"fmt"
+	"iter"
+	"time"
+)
+
+// All returns an iterator over the key/value pairs of the bucket that have not expired, in no
+//  particular order. The bucket is not copied: its keys are read a chunk at a time and the value
+//  of each key is read again when it is reached, so the loop body runs without lock and can call
+//  methods of the bucket. Keys set or deleted during the iteration may or may not be visited.
+func (c *Bucket) All() iter.Seq2[string, string] {
+	return func(yield func(string, string) bool) {
+		c.ForEach(yield)
+	}
+}
+
+// ForEach calls f for the key/value pairs of the bucket that have not expired until f returns false.
+//  As with All, f runs without lock.
+func (c *Bucket) ForEach(f func(k, v string) bool) {
+	c.bucket.each(func(k string, item Item) bool {
+		return f(k, fmt.Sprintf("%v", item.Object))
+	})
+}
+
+// each calls f for the items that have not expired until f returns false. The keys of a shard
+// are collected chunkItems at a time, f being called with the shard unlocked and the current item
+// of each key.
+func (c *bucketInternal) each(f func(k string, item Item) bool) {
+	keys := make([]string, 0, chunkItems)
+	for _, s := range c.shards {
+		if !s.chunks(chunkItems, func(k string, _ Item) {
+			keys = append(keys, k)
+		}, func() bool {
+			for _, k := range keys {
+				if item, found := s.lookup(k); found && !f(k, item) {
+					return false
+				}
+			}
+			keys = keys[:0]
+			return true
+		}) {
+			return
+		}
+	}
+}
+
+// lookup returns the item of k if it has not expired, without counting an access for the policy
+func (s *shard) lookup(k string) (Item, bool) {
+	s.mu.RLock()
+	item, found := s.items[k]
+	s.mu.RUnlock()
+	return item, found && !item.expired()
+}
+
+// chunks calls collect for the items of the shard that have not expired with the shard read
+// locked, and emit with the shard unlocked after every n of them and after the last one, until
+// emit returns false. The iteration resumes where it stopped: items set or deleted while the shard
+// is unlocked may or may not be collected, the others are collected once.
+func (s *shard) chunks(n int, collect func(k string, item Item), emit func() bool) bool {
+	now := time.Now().UnixNano()
+	s.mu.RLock()
+	locked := true
+	defer func() {
+		if locked {
+			s.mu.RUnlock()
+		}
+	}()
+	collected := 0
+	for k, item := range s.items {
+		if item.expiredAt(now) {
+			continue
+		}
+		collect(k, item)
+		if collected++; collected < n {
+			continue
+		}
+		s.mu.RUnlock()
+		locked = false
+		if !emit() {
+			return false
+		}
+		collected = 0
+		s.mu.RLock()
+		locked = true
+	}
+	s.mu.RUnlock()
+	locked = false
+	return collected == 0 || emit()
+}
+
+// visit calls f for the items of the shard that have not expired at now until f returns false,
+// which is then returned. s.mu must be held, at least for reading.
+func (s *shard) visit(now int64, f func(k string, item Item) bool) bool {
+	for k, item := range s.items {
+		if item.expiredAt(now) {
+			continue
+		}
+		if !f(k, item) {
+			return false
+		}
+	}
+	return true
+}
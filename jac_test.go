@@ -1,9 +1,20 @@
 package jac
 
 import (
+	"context"
+	"encoding/gob"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"hash/maphash"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
 	"strconv"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -72,3 +83,1446 @@ func Test_jac(t *testing.T) {
 	time.Sleep(2 * time.Second)
 
 }
+
+func Test_tombstones(t *testing.T) {
+	t.Parallel()
+	o := testOptions(t)
+	cache := newTestCache(t, o)
+	bucket, e := cache.NewBucket("tombstones", NoExpiration)
+	if e != nil {
+		t.Fatal(e)
+	}
+	bucket.Set("one", 1, NoExpiration, true)
+	bucket.Set("two", 2, NoExpiration, true)
+	bucket.Delete("one")
+	time.Sleep(100 * time.Millisecond)
+
+	// simulate a crash by loading the working file without closing the bucket
+	recovered, e := newTestCache(t, o).NewBucket("tombstones", NoExpiration)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if _, found := recovered.Get("one"); found {
+		t.Errorf("deleted key resurrected")
+	}
+	if v, found := recovered.Get("two"); !found || v != "2" {
+		t.Errorf("missing data")
+	}
+
+	recovered.Flush()
+	time.Sleep(100 * time.Millisecond)
+	recovered, e = newTestCache(t, o).NewBucket("tombstones", NoExpiration)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if n := recovered.ItemCount(); n != 0 {
+		t.Errorf("flushed bucket recovered %d items", n)
+	}
+	recovered.Close(false)
+}
+
+func Test_expirationPersistence(t *testing.T) {
+	t.Parallel()
+	o := testOptions(t)
+	cache := newTestCache(t, o)
+	bucket, e := cache.NewBucket("expiration", NoExpiration)
+	if e != nil {
+		t.Fatal(e)
+	}
+	bucket.Set("short", "gone", 500*time.Millisecond, true)
+	bucket.Set("long", "kept", time.Hour, true)
+	_, deadline, _ := bucket.GetWithExpiration("long")
+	time.Sleep(100 * time.Millisecond)
+
+	// crash recovery from the working file
+	recovered, e := newTestCache(t, o).NewBucket("expiration", 10*time.Hour)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if _, exp, found := recovered.GetWithExpiration("long"); !found || !exp.Equal(deadline) {
+		t.Errorf("expiration not preserved in working file: %v != %v", exp, deadline)
+	}
+
+	// recovery from the rec file after the short key expired
+	recovered.Close(false)
+	time.Sleep(500 * time.Millisecond)
+	recovered, e = newTestCache(t, o).NewBucket("expiration", 10*time.Hour)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if _, found := recovered.Get("short"); found {
+		t.Errorf("expired key loaded")
+	}
+	if _, exp, found := recovered.GetWithExpiration("long"); !found || !exp.Equal(deadline) {
+		t.Errorf("expiration not preserved in rec file: %v != %v", exp, deadline)
+	}
+	recovered.Close(false)
+}
+
+func Test_compaction(t *testing.T) {
+	t.Parallel()
+	o := testOptions(t)
+	folder := o.WorkingFolder
+	cache := newTestCache(t, o)
+	bucket, e := cache.NewBucket("compaction", NoExpiration)
+	if e != nil {
+		t.Fatal(e)
+	}
+	bucket.Set("before", 1, NoExpiration, true)
+	bucket.Set("deleted", 2, NoExpiration, true)
+	bucket.Delete("deleted")
+	bucket.Compact()
+	time.Sleep(100 * time.Millisecond)
+	// records written after the compaction must land in the new working file
+	bucket.Set("after", 3, NoExpiration, true)
+	time.Sleep(100 * time.Millisecond)
+
+	recovered, e := newTestCache(t, o).NewBucket("compaction", NoExpiration)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if n := recovered.ItemCount(); n != 2 {
+		t.Errorf("recovered %d items instead of 2", n)
+	}
+	if _, found := recovered.Get("after"); !found {
+		t.Errorf("record written after compaction lost")
+	}
+	recovered.Close(true)
+	if tmp, _ := filepath.Glob(filepath.Join(folder, "*.tmp")); len(tmp) != 0 {
+		t.Errorf("temporary files left behind: %v", tmp)
+	}
+}
+
+func Test_durability(t *testing.T) {
+	t.Parallel()
+	o := testOptions(t)
+	o.Durability = SyncEveryInterval
+	o.SyncIntervalMs = 20
+	cache := newTestCache(t, o)
+	bucket, e := cache.NewBucket("durability", NoExpiration)
+	if e != nil {
+		t.Fatal(e)
+	}
+	bucket.Set("grouped", 1, NoExpiration, true)
+	// the critical record is synced before SetWithDurability returns, no need to wait
+	if err := bucket.SetWithDurability("critical", 2, NoExpiration, SyncEveryWrite); err != nil {
+		t.Fatal(err)
+	}
+	recovered, e := newTestCache(t, o).NewBucket("durability", NoExpiration)
+	if e != nil {
+		t.Fatal(e)
+	}
+	for _, k := range []string{"grouped", "critical"} {
+		if _, found := recovered.Get(k); !found {
+			t.Errorf("record %v lost", k)
+		}
+	}
+	recovered.Close(false)
+}
+
+func Test_recoveryReport(t *testing.T) {
+	t.Parallel()
+	o := testOptions(t)
+	folder := o.WorkingFolder
+	cache := newTestCache(t, o)
+	bucket, e := cache.NewBucket("report", NoExpiration)
+	if e != nil {
+		t.Fatal(e)
+	}
+	bucket.Set("one", 1, NoExpiration, true)
+	bucket.Set("two", 2, NoExpiration, true)
+	time.Sleep(100 * time.Millisecond)
+	// a torn record followed by a valid one
+	f, err := os.OpenFile(filepath.Join(folder, "report.data"), os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = f.WriteString("0badc0de {\"op\":\"set\",\"key\":\"thr\n")
+	line, _ := encodeRecord(FileData{Op: opSet, Key: "four", Value: "4"})
+	_, _ = f.Write(line)
+	_ = f.Close()
+
+	recovered, e := newTestCache(t, o).NewBucket("report", NoExpiration)
+	if e != nil {
+		t.Fatal(e)
+	}
+	report := recovered.Recovery()
+	if report.Version != dataVersion || report.Recovered != 2 || report.Discarded != 2 || !errors.Is(report.Err, CorruptRecord) {
+		t.Errorf("unexpected report %+v", report)
+	}
+	if _, found := recovered.Get("four"); found {
+		t.Errorf("record after a corrupt one loaded")
+	}
+	recovered.Close(false)
+
+	// working files written before versioning have no header nor checksums
+	legacy := "{\"key\":\"one\",\"value\":\"1\"}\n{\"key\":\"two\",\"value\":\"2\"}\n"
+	if err = os.WriteFile(filepath.Join(folder, "legacy.data"), []byte(legacy), 0666); err != nil {
+		t.Fatal(err)
+	}
+	recovered, e = newTestCache(t, o).NewBucket("legacy", NoExpiration)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if report = recovered.Recovery(); report.Version != 0 || report.Recovered != 2 || report.Err != nil {
+		t.Errorf("unexpected report %+v", report)
+	}
+	recovered.Close(false)
+
+	// recovery files hold the items in chunks
+	bucket, e = newTestCache(t, o).NewBucket("chunked", NoExpiration)
+	if e != nil {
+		t.Fatal(e)
+	}
+	for i := 0; i <= 2*chunkItems; i++ {
+		bucket.Set(strconv.Itoa(i), i, NoExpiration, false)
+	}
+	bucket.Close(true)
+	recovered, e = newTestCache(t, o).NewBucket("chunked", NoExpiration)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if report = recovered.Recovery(); !strings.HasSuffix(report.Source, ".rec") || report.Recovered != 2*chunkItems+1 || report.Err != nil {
+		t.Errorf("unexpected report %+v", report)
+	}
+	if v, _ := recovered.Get("2000"); v != "2000" {
+		t.Errorf("2000 recovered as %q", v)
+	}
+	recovered.Close(false)
+	// those written before in a single map
+	f, err = os.Create(filepath.Join(o.RecoveryFolder, "single.rec"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = gob.NewEncoder(f).Encode(map[string]Item{"one": {Object: "1"}, "two": {Object: "2"}}); err != nil {
+		t.Fatal(err)
+	}
+	_ = f.Close()
+	recovered, e = newTestCache(t, o).NewBucket("single", NoExpiration)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if report = recovered.Recovery(); report.Recovered != 2 || report.Err != nil {
+		t.Errorf("unexpected report %+v", report)
+	}
+	recovered.Close(false)
+}
+
+func Test_instances(t *testing.T) {
+	t.Parallel()
+	volatile, durable := testOptions(t), testOptions(t)
+	durable.Durability = SyncEveryWrite
+	caches := []*Cache{newTestCache(t, volatile), newTestCache(t, durable)}
+	for i, c := range caches {
+		bucket, e := c.NewBucket("shared", NoExpiration)
+		if e != nil {
+			t.Fatal(e)
+		}
+		bucket.Set("owner", i, NoExpiration, true)
+	}
+	if caches[0].Options().WorkingFolder == caches[1].Options().WorkingFolder {
+		t.Fatal("caches share their working folder")
+	}
+	time.Sleep(100 * time.Millisecond)
+	for i, o := range []Options{volatile, durable} {
+		bucket, e := newTestCache(t, o).NewBucket("shared", NoExpiration)
+		if e != nil {
+			t.Fatal(e)
+		}
+		if v, _ := bucket.Get("owner"); v != strconv.Itoa(i) {
+			t.Errorf("cache %d recovered %q", i, v)
+		}
+	}
+}
+
+func Test_registry(t *testing.T) {
+	t.Parallel()
+	o := testOptions(t)
+	cache := newTestCache(t, o)
+	for _, name := range []string{"b", "a", "dropped"} {
+		bucket, e := cache.NewBucket(name, NoExpiration)
+		if e != nil {
+			t.Fatal(e)
+		}
+		bucket.Set("key", name, NoExpiration, true)
+	}
+	if _, e := cache.NewBucket("a", NoExpiration); e != BucketAlreadyOpen {
+		t.Errorf("bucket opened twice: %v", e)
+	}
+	if bucket, found := cache.Bucket("b"); !found {
+		t.Errorf("bucket b not found")
+	} else if v, _ := bucket.Get("key"); v != "b" {
+		t.Errorf("wrong bucket returned")
+	}
+	if err := cache.Drop("dropped"); err != nil {
+		t.Error(err)
+	}
+	if err := cache.Drop("dropped"); err != BucketNotOpen {
+		t.Errorf("bucket dropped twice: %v", err)
+	}
+	if names := cache.Buckets(); fmt.Sprint(names) != "[a b]" {
+		t.Errorf("unexpected buckets %v", names)
+	}
+	// Terminate closes the buckets that are still open, storing their recovery files
+	if err := cache.Terminate(); err != nil {
+		t.Error(err)
+	}
+	for _, name := range []string{"a", "b"} {
+		if _, err := os.Stat(filepath.Join(o.RecoveryFolder, name+".rec")); err != nil {
+			t.Errorf("bucket %v not closed: %v", name, err)
+		}
+	}
+	if files, _ := filepath.Glob(filepath.Join(o.WorkingFolder, "dropped.*")); len(files) != 0 {
+		t.Errorf("dropped bucket files left behind: %v", files)
+	}
+}
+
+func Test_errors(t *testing.T) {
+	t.Parallel()
+	o := testOptions(t)
+	blocker := filepath.Join(o.WorkingFolder, "file")
+	if err := os.WriteFile(blocker, nil, 0666); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := New(&Options{WorkingFolder: filepath.Join(blocker, "folder")}); err == nil {
+		t.Errorf("invalid working folder accepted")
+	}
+
+	reported := make(chan error, 1)
+	o.OnError = func(err error) { reported <- err }
+	bucket, e := newTestCache(t, o).NewBucket("errors", NoExpiration)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if err := bucket.SetE("", 1, NoExpiration, true); err != IllegalParameter {
+		t.Errorf("empty key accepted: %v", err)
+	}
+	_ = bucket.Close(false)
+	// the working file is closed, the record cannot be written
+	if err := bucket.SetE("late", 1, NoExpiration, true); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-reported:
+		var pe *PersistenceError
+		if !errors.As(err, &pe) || pe.Bucket != "errors" || pe.Key != "late" || !errors.Is(err, os.ErrClosed) {
+			t.Errorf("unexpected error %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("write error not reported")
+	}
+}
+
+func Test_typed(t *testing.T) {
+	t.Parallel()
+	o := testOptions(t)
+	bucket, e := newTestCache(t, o).NewBucket("typed", NoExpiration)
+	if e != nil {
+		t.Fatal(e)
+	}
+	records := NewTypedBucket[testData](bucket, JSONCodec[testData]{})
+	if err := records.Set("1", testData{Id: "1", Flag1: true, Value: 1}, NoExpiration, true); err != nil {
+		t.Fatal(err)
+	}
+	blobs := NewTypedBucket[[]byte](bucket, BytesCodec{})
+	binary := []byte{0xff, 0x00, 0xfe, 'j', 'a', 'c'}
+	if err := blobs.Set("blob", binary, NoExpiration, true); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	// working file
+	recovered, e := newTestCache(t, o).NewBucket("typed", NoExpiration)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if v, found, err := NewTypedBucket[testData](recovered, JSONCodec[testData]{}).Get("1"); !found || err != nil || v.Value != 1 || !v.Flag1 {
+		t.Errorf("struct not recovered: %+v %v", v, err)
+	}
+	if v, _, _ := NewTypedBucket[[]byte](recovered, BytesCodec{}).Get("blob"); string(v) != string(binary) {
+		t.Errorf("bytes not recovered from working file: %v", v)
+	}
+
+	// recovery file
+	_ = recovered.Close(false)
+	recovered, e = newTestCache(t, o).NewBucket("typed", NoExpiration)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if v, _, _ := NewTypedBucket[[]byte](recovered, BytesCodec{}).Get("blob"); string(v) != string(binary) {
+		t.Errorf("bytes not recovered from rec file: %v", v)
+	}
+}
+
+func Test_limits(t *testing.T) {
+	t.Parallel()
+	o := testOptions(t)
+	bucket, e := newTestCache(t, o).NewBucketWithOptions("limits", NoExpiration, &BucketOptions{MaxItems: 3, MaxBytes: 50})
+	if e != nil {
+		t.Fatal(e)
+	}
+	evicted := make(chan string, 10)
+	bucket.OnEvicted(func(k, _ string, reason EvictReason) {
+		if reason == EvictCapacity {
+			evicted <- k
+		}
+	})
+	for _, k := range []string{"a", "b", "c"} {
+		bucket.Set(k, k, NoExpiration, true)
+	}
+	bucket.Get("a")
+	bucket.Set("d", "d", NoExpiration, true)
+	if k := <-evicted; k != "b" {
+		t.Errorf("evicted %v instead of the least recently used key", k)
+	}
+	// a large value pushes out older items to respect MaxBytes
+	bucket.Set("e", strings.Repeat("e", 48), NoExpiration, true)
+	if n := bucket.ItemCount(); n != 1 {
+		t.Errorf("%d items left instead of 1", n)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	recovered, e := newTestCache(t, o).NewBucket("limits", NoExpiration)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if items := recovered.Items(); len(items) != 1 || items["e"] == "" {
+		t.Errorf("evicted items recovered: %v", items)
+	}
+}
+
+func Test_callbacks(t *testing.T) {
+	t.Parallel()
+	bucket, e := newTestCache(t, testOptions(t)).NewBucketWithOptions("callbacks", NoExpiration, &BucketOptions{MaxItems: 2, CallbackWorkers: 4})
+	if e != nil {
+		t.Fatal(e)
+	}
+	calls := make(chan string, 20)
+	bucket.OnEvicted(func(k, v string, reason EvictReason) { calls <- fmt.Sprintf("%v %s=%s", reason, k, v) })
+	bucket.OnSet(func(k, v string) { calls <- fmt.Sprintf("set %s=%s", k, v) })
+	bucket.OnExpired(func(k, v string) { calls <- fmt.Sprintf("onexpired %s=%s", k, v) })
+	next := func(want string) {
+		t.Helper()
+		select {
+		case got := <-calls:
+			if got != want {
+				t.Errorf("callback %q instead of %q", got, want)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("callback %q not called", want)
+		}
+	}
+	bucket.Set("a", 1, NoExpiration, false)
+	next("set a=1")
+	bucket.Set("a", 2, NoExpiration, false)
+	next("replaced a=1")
+	next("set a=2")
+	bucket.Delete("a")
+	next("deleted a=2")
+	bucket.Set("b", "b", 10*time.Millisecond, false)
+	next("set b=b")
+	time.Sleep(20 * time.Millisecond)
+	bucket.DeleteExpired()
+	next("expired b=b")
+	next("onexpired b=b")
+	// callbacks of different keys may run in any order
+	unordered := func(n int, want string) {
+		t.Helper()
+		got := make([]string, n)
+		for i := range got {
+			got[i] = <-calls
+		}
+		sort.Strings(got)
+		if fmt.Sprint(got) != want {
+			t.Errorf("callbacks %v instead of %v", got, want)
+		}
+	}
+	for _, k := range []string{"c", "d", "e"} {
+		bucket.Set(k, k, NoExpiration, false)
+	}
+	unordered(4, "[capacity c=c set c=c set d=d set e=e]")
+	bucket.Flush()
+	unordered(2, "[flushed d=d flushed e=e]")
+	// callbacks may write to the bucket as they run outside its lock
+	bucket.OnSet(func(k, v string) {
+		calls <- fmt.Sprintf("set %s=%s", k, v)
+		if k == "f" {
+			bucket.Set("g", v, NoExpiration, false)
+		}
+	})
+	bucket.Set("f", "f", NoExpiration, false)
+	next("set f=f")
+	next("set g=f")
+	if e := bucket.Close(false); e != nil {
+		t.Error(e)
+	}
+}
+
+// callbacks writing to the bucket must not block the workers, even with many pending callbacks
+func Test_callbacksWriting(t *testing.T) {
+	t.Parallel()
+	bucket, e := newTestCache(t, testOptions(t)).NewBucketWithOptions("writing", NoExpiration, &BucketOptions{Shards: 4})
+	if e != nil {
+		t.Fatal(e)
+	}
+	var restored atomic.Int32
+	bucket.OnEvicted(func(k, v string, reason EvictReason) {
+		if reason == EvictFlushed {
+			bucket.Set("restored:"+k, v, NoExpiration, false)
+			restored.Add(1)
+		}
+	})
+	// fewer values than the queue of the worker holds, so that no callback is dropped
+	const values = callbackQueue - 1
+	for i := 0; i < values; i++ {
+		bucket.Set(strconv.Itoa(i), i, NoExpiration, false)
+	}
+	flushed := make(chan bool)
+	go func() {
+		bucket.Flush()
+		flushed <- true
+	}()
+	select {
+	case <-flushed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Flush blocked by the callbacks")
+	}
+	for i := 0; restored.Load() < values; i++ {
+		if i == 500 {
+			t.Fatalf("%d callbacks run", restored.Load())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := bucket.ItemCount(); n != values {
+		t.Errorf("%d items written by the callbacks", n)
+	}
+}
+
+// a stalled callback must neither block the writers nor queue notices without limit
+func Test_callbacksStalled(t *testing.T) {
+	t.Parallel()
+	o := testOptions(t)
+	o.LoadDelayMs = 1
+	var dropped atomic.Int32
+	o.OnError = func(err error) {
+		if errors.Is(err, CallbackDropped) {
+			dropped.Add(1)
+		}
+	}
+	bucket, e := newTestCache(t, o).NewBucket("stalled", NoExpiration)
+	if e != nil {
+		t.Fatal(e)
+	}
+	release := make(chan bool)
+	var run atomic.Int32
+	bucket.OnSet(func(k, v string) {
+		run.Add(1)
+		<-release
+	})
+	const writes = 1000
+	written := make(chan bool)
+	go func() {
+		for i := 0; i < writes; i++ {
+			bucket.Set(strconv.Itoa(i), i, NoExpiration, false)
+		}
+		written <- true
+	}()
+	select {
+	case <-written:
+	case <-time.After(10 * time.Second):
+		t.Fatal("writers blocked by a stalled callback")
+	}
+	// the worker holds one notice and its queue callbackQueue
+	if n := dropped.Load(); n < writes-callbackQueue-1 {
+		t.Errorf("%d callbacks dropped, %d queued", n, writes-n)
+	}
+	close(release)
+	for i := 0; run.Load()+dropped.Load() < writes; i++ {
+		if i == 100 {
+			t.Fatalf("%d callbacks run and %d dropped", run.Load(), dropped.Load())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// a panic in a function given to the bucket must not leave it locked
+func Test_panics(t *testing.T) {
+	t.Parallel()
+	bucket, e := newTestCache(t, testOptions(t)).NewBucketWithOptions("panics", NoExpiration, &BucketOptions{Shards: 4})
+	if e != nil {
+		t.Fatal(e)
+	}
+	bucket.Set("k", "v", NoExpiration, false)
+	recovered := func(f func()) {
+		t.Helper()
+		defer func() {
+			if recover() == nil {
+				t.Error("no panic")
+			}
+		}()
+		f()
+	}
+	recovered(func() {
+		bucket.FunctionUpdate("k", func(k, v string) (string, string) { panic("update") }, NoExpiration, false)
+	})
+	recovered(func() {
+		_ = bucket.Txn(func(tx *Tx) error { panic("txn") })
+	})
+	recovered(func() {
+		for range bucket.All() {
+			panic("loop body")
+		}
+	})
+	written := make(chan bool)
+	go func() {
+		bucket.Set("k", "w", NoExpiration, false)
+		bucket.Flush()
+		written <- true
+	}()
+	select {
+	case <-written:
+	case <-time.After(time.Second):
+		t.Fatal("bucket left locked")
+	}
+}
+
+// writes made while the working file is compacted are neither dropped nor lost
+func Test_compactWhileWriting(t *testing.T) {
+	t.Parallel()
+	o := testOptions(t)
+	var drops atomic.Int32
+	o.OnError = func(err error) {
+		if errors.Is(err, RecordDropped) {
+			drops.Add(1)
+		}
+	}
+	bucket, e := newTestCache(t, o).NewBucketWithOptions("compacting", NoExpiration, &BucketOptions{Shards: 8})
+	if e != nil {
+		t.Fatal(e)
+	}
+	items := make(map[string]interface{}, 50000)
+	for i := 0; i < 50000; i++ {
+		items[strconv.Itoa(i)] = i
+	}
+	bucket.SetMany(items, NoExpiration, true)
+	// returns once the batch has been written
+	if e := bucket.SetWithDurability("loaded", true, NoExpiration, SyncEveryWrite); e != nil {
+		t.Fatal(e)
+	}
+	before, e := os.Stat(bucket.file.path)
+	if e != nil {
+		t.Fatal(e)
+	}
+	stop := make(chan bool)
+	done := make(chan bool)
+	for w := 0; w < 4; w++ {
+		go func(w int) {
+			for i := 0; ; i++ {
+				select {
+				case <-stop:
+					done <- true
+					return
+				default:
+				}
+				bucket.Set(fmt.Sprintf("w%d:%d", w, i%100), i, NoExpiration, true)
+				if i%10 == 0 {
+					bucket.Delete(strconv.Itoa(w*5000 + i))
+				}
+				// well below the throughput of the working file writer
+				time.Sleep(100 * time.Microsecond)
+			}
+		}(w)
+	}
+	// the request is not queued when the writer is busy
+	for replaced := false; !replaced; {
+		bucket.Compact()
+		for i := 0; i < 100 && !replaced; i++ {
+			time.Sleep(10 * time.Millisecond)
+			after, e := os.Stat(bucket.file.path)
+			replaced = e == nil && !os.SameFile(before, after)
+		}
+	}
+	close(stop)
+	for w := 0; w < 4; w++ {
+		<-done
+	}
+	time.Sleep(100 * time.Millisecond)
+	if n := drops.Load(); n != 0 {
+		t.Errorf("%d records dropped during compaction", n)
+	}
+
+	recovered, e := newTestCache(t, o).NewBucket("compacting", NoExpiration)
+	if e != nil {
+		t.Fatal(e)
+	}
+	want, got := bucket.Items(), recovered.Items()
+	if len(got) != len(want) {
+		t.Errorf("%d items recovered instead of %d", len(got), len(want))
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("%v recovered as %q instead of %q", k, got[k], v)
+			break
+		}
+	}
+}
+
+func Test_shards(t *testing.T) {
+	t.Parallel()
+	o := testOptions(t)
+	bucket, e := newTestCache(t, o).NewBucketWithOptions("shards", NoExpiration, &BucketOptions{Shards: 8})
+	if e != nil {
+		t.Fatal(e)
+	}
+	done := make(chan bool)
+	for w := 0; w < 8; w++ {
+		go func(w int) {
+			for i := 0; i < 100; i++ {
+				k := strconv.Itoa(w*100 + i)
+				bucket.Set(k, k, NoExpiration, true)
+				bucket.FunctionUpdate(k, func(k, v string) (string, string) { return "r" + k, v }, NoExpiration, true)
+			}
+			done <- true
+		}(w)
+	}
+	for w := 0; w < 8; w++ {
+		<-done
+	}
+	if n := bucket.ItemCount(); n != 800 {
+		t.Errorf("%d items instead of 800", n)
+	}
+	if v, found := bucket.Get("r42"); !found || v != "42" {
+		t.Errorf("renamed key not found: %v %v", v, found)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	recovered, e := newTestCache(t, o).NewBucketWithOptions("shards", NoExpiration, &BucketOptions{Shards: 3})
+	if e != nil {
+		t.Fatal(e)
+	}
+	if items := recovered.Items(); len(items) != 800 || items["r799"] != "799" {
+		t.Errorf("%d items recovered with a different shard count", len(items))
+	}
+	recovered.Flush()
+	if n := recovered.ItemCount(); n != 0 {
+		t.Errorf("%d items left after Flush", n)
+	}
+	if _, e := newTestCache(t, testOptions(t)).NewBucketWithOptions("negative", NoExpiration, &BucketOptions{Shards: -1}); e != IllegalParameter {
+		t.Errorf("negative shard count accepted: %v", e)
+	}
+	// limits are shared among shards
+	bounded, e := newTestCache(t, testOptions(t)).NewBucketWithOptions("bounded", NoExpiration, &BucketOptions{Shards: 4, MaxItems: 40})
+	if e != nil {
+		t.Fatal(e)
+	}
+	for i := 0; i < 1000; i++ {
+		bounded.Set(strconv.Itoa(i), i, NoExpiration, false)
+	}
+	if n := bounded.ItemCount(); n > 40 {
+		t.Errorf("%d items in a bucket bounded to 40", n)
+	}
+	// also when they are not a multiple of the shard count
+	uneven, e := newTestCache(t, testOptions(t)).NewBucketWithOptions("uneven", NoExpiration, &BucketOptions{Shards: 4, MaxItems: 10})
+	if e != nil {
+		t.Fatal(e)
+	}
+	for i := 0; i < 1000; i++ {
+		uneven.Set(strconv.Itoa(i), i, NoExpiration, false)
+	}
+	if n := uneven.ItemCount(); n > 10 {
+		t.Errorf("%d items in a bucket bounded to 10", n)
+	}
+	for _, small := range []*BucketOptions{{Shards: 4, MaxItems: 3}, {Shards: 4, MaxBytes: 3}} {
+		if _, e := newTestCache(t, testOptions(t)).NewBucketWithOptions("small", NoExpiration, small); e != IllegalParameter {
+			t.Errorf("limits smaller than the shard count accepted: %v", e)
+		}
+	}
+}
+
+func Test_getOrLoad(t *testing.T) {
+	t.Parallel()
+	bucket, e := newTestCache(t, testOptions(t)).NewBucketWithOptions("load", NoExpiration,
+		&BucketOptions{StaleFor: time.Minute, NegativeTTL: time.Minute})
+	if e != nil {
+		t.Fatal(e)
+	}
+	var calls atomic.Int32
+	release := make(chan bool)
+	loader := func(ctx context.Context) (interface{}, time.Duration, error) {
+		calls.Add(1)
+		<-release
+		return 42, 50 * time.Millisecond, nil
+	}
+	// concurrent misses share a single loader call
+	results := make(chan string)
+	for i := 0; i < 10; i++ {
+		go func() {
+			v, _ := bucket.GetOrLoad(context.Background(), "k", loader)
+			results <- v
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	for i := 0; i < 10; i++ {
+		if v := <-results; v != "42" {
+			t.Errorf("loaded %q instead of 42", v)
+		}
+	}
+	if n := calls.Load(); n != 1 {
+		t.Errorf("%d loader calls instead of 1", n)
+	}
+	// an expired value is served while it is reloaded
+	time.Sleep(100 * time.Millisecond)
+	if v, e := bucket.GetOrLoad(context.Background(), "k", func(ctx context.Context) (interface{}, time.Duration, error) {
+		return 43, NoExpiration, nil
+	}); e != nil || v != "42" {
+		t.Errorf("stale value not served: %q %v", v, e)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if v, _ := bucket.Get("k"); v != "43" {
+		t.Errorf("value not refreshed: %q", v)
+	}
+	// loader errors are cached for NegativeTTL
+	failure := errors.New("not found")
+	failing := func(ctx context.Context) (interface{}, time.Duration, error) {
+		calls.Add(1)
+		return nil, 0, failure
+	}
+	calls.Store(0)
+	for i := 0; i < 3; i++ {
+		if _, e := bucket.GetOrLoad(context.Background(), "missing", failing); e != failure {
+			t.Errorf("loader error not returned: %v", e)
+		}
+	}
+	if n := calls.Load(); n != 1 {
+		t.Errorf("%d loader calls instead of 1 with negative caching", n)
+	}
+	if _, e := bucket.GetOrLoad(context.Background(), "panic", func(ctx context.Context) (interface{}, time.Duration, error) {
+		panic("boom")
+	}); !errors.Is(e, LoaderPanic) {
+		t.Errorf("loader panic not reported: %v", e)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, e := bucket.GetOrLoad(ctx, "slow", func(ctx context.Context) (interface{}, time.Duration, error) {
+		time.Sleep(100 * time.Millisecond)
+		return "slow", NoExpiration, nil
+	}); e != context.DeadlineExceeded {
+		t.Errorf("wait not cancelled: %v", e)
+	}
+}
+
+func Test_versions(t *testing.T) {
+	t.Parallel()
+	o := testOptions(t)
+	bucket, e := newTestCache(t, o).NewBucket("versions", NoExpiration)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if _, swapped := bucket.CompareAndSwap("k", 0, "created", NoExpiration, true); !swapped {
+		t.Error("missing key not created with expected version 0")
+	}
+	_, v1, _ := bucket.GetWithVersion("k")
+	bucket.Set("k", "updated", NoExpiration, true)
+	v, v2, _ := bucket.GetWithVersion("k")
+	if v != "updated" || v2 <= v1 {
+		t.Errorf("version %d not increased from %d", v2, v1)
+	}
+	// a client holding an old version cannot overwrite a newer value
+	if current, swapped := bucket.CompareAndSwap("k", v1, "lost", NoExpiration, true); swapped || current != v2 {
+		t.Errorf("stale version accepted: %d %v", current, swapped)
+	}
+	v3, swapped := bucket.CompareAndSwap("k", v2, "swapped", NoExpiration, true)
+	if !swapped || v3 <= v2 {
+		t.Errorf("swap failed: %d %v", v3, swapped)
+	}
+	bucket.Set("gone", "x", NoExpiration, true)
+	_, gone, _ := bucket.GetWithVersion("gone")
+	bucket.Delete("gone")
+	time.Sleep(100 * time.Millisecond)
+
+	// versions survive a crash, those of deleted keys are not given again
+	crashed, e := newTestCache(t, o).NewBucket("versions", NoExpiration)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if _, v, _ := crashed.GetWithVersion("k"); v != v3 {
+		t.Errorf("version %d recovered instead of %d", v, v3)
+	}
+	crashed.Set("gone", "y", NoExpiration, true)
+	if _, v, _ := crashed.GetWithVersion("gone"); v <= gone {
+		t.Errorf("version %d given again after a restart", v)
+	}
+	crashed.Compact()
+	if e = crashed.Close(true); e != nil {
+		t.Fatal(e)
+	}
+
+	// and a normal termination
+	closed, e := newTestCache(t, o).NewBucket("versions", NoExpiration)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if _, v, _ := closed.GetWithVersion("k"); v != v3 {
+		t.Errorf("version %d recovered from the rec file instead of %d", v, v3)
+	}
+}
+
+func Test_counters(t *testing.T) {
+	t.Parallel()
+	o := testOptions(t)
+	bucket, e := newTestCache(t, o).NewBucket("counters", NoExpiration)
+	if e != nil {
+		t.Fatal(e)
+	}
+	done := make(chan bool)
+	for w := 0; w < 10; w++ {
+		go func() {
+			for i := 0; i < 100; i++ {
+				if _, e := bucket.Increment("hits", 1, NoExpiration, true); e != nil {
+					t.Error(e)
+				}
+			}
+			done <- true
+		}()
+	}
+	for w := 0; w < 10; w++ {
+		<-done
+	}
+	if n, e := bucket.Decrement("hits", 10, NoExpiration, true); e != nil || n != 990 {
+		t.Errorf("counter at %d instead of 990: %v", n, e)
+	}
+	// an existing key keeps its expiration time
+	bucket.Set("quota", 5, time.Hour, true)
+	_, exp, _ := bucket.GetWithExpiration("quota")
+	if n, e := bucket.Increment("quota", 1, NoExpiration, true); e != nil || n != 6 {
+		t.Errorf("quota at %d instead of 6: %v", n, e)
+	}
+	if _, after, _ := bucket.GetWithExpiration("quota"); !after.Equal(exp) {
+		t.Errorf("expiration changed from %v to %v", exp, after)
+	}
+	if f, e := bucket.IncrementFloat("rate", 0.5, NoExpiration, true); e != nil || f != 0.5 {
+		t.Errorf("rate at %v instead of 0.5: %v", f, e)
+	}
+	bucket.Set("name", "jac", NoExpiration, true)
+	if _, e := bucket.Increment("name", 1, NoExpiration, true); !errors.Is(e, NotNumeric) {
+		t.Errorf("non numeric value incremented: %v", e)
+	}
+	// overflows are reported instead of wrapping around
+	bucket.Set("max", math.MaxInt64, NoExpiration, true)
+	if n, e := bucket.Increment("max", 1, NoExpiration, true); !errors.Is(e, Overflow) {
+		t.Errorf("MaxInt64 incremented to %d: %v", n, e)
+	}
+	if v, _ := bucket.Get("max"); v != strconv.FormatInt(math.MaxInt64, 10) {
+		t.Errorf("overflowing counter changed to %v", v)
+	}
+	if n, e := bucket.Decrement("min", math.MinInt64, NoExpiration, true); !errors.Is(e, Overflow) {
+		t.Errorf("0 decremented by MinInt64 to %d: %v", n, e)
+	}
+	if n, e := bucket.Decrement("max", -1, NoExpiration, true); !errors.Is(e, Overflow) {
+		t.Errorf("MaxInt64 decremented by -1 to %d: %v", n, e)
+	}
+	if n, e := bucket.Increment("max", math.MinInt64, NoExpiration, true); e != nil || n != -1 {
+		t.Errorf("MaxInt64 + MinInt64 is %d: %v", n, e)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	recovered, e := newTestCache(t, o).NewBucket("counters", NoExpiration)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if v, _ := recovered.Get("hits"); v != "990" {
+		t.Errorf("counter recovered as %q", v)
+	}
+}
+
+func Test_ttl(t *testing.T) {
+	t.Parallel()
+	o := testOptions(t)
+	bucket, e := newTestCache(t, o).NewBucket("ttl", NoExpiration)
+	if e != nil {
+		t.Fatal(e)
+	}
+	bucket.Set("session", "s", 100*time.Millisecond, true)
+	bucket.Set("token", "t", time.Hour, true)
+	bucket.Set("deadline", "d", NoExpiration, true)
+	_, v1, _ := bucket.GetWithVersion("session")
+	if !bucket.Touch("session", time.Hour) || !bucket.Persist("token") || !bucket.ExpireAt("deadline", time.Now().Add(time.Minute)) {
+		t.Fatal("expiration not changed")
+	}
+	if bucket.Touch("missing", time.Hour) {
+		t.Error("missing key touched")
+	}
+	if d, _ := bucket.TTL("session"); d < 59*time.Minute {
+		t.Errorf("session TTL %v after Touch", d)
+	}
+	if _, v2, _ := bucket.GetWithVersion("session"); v2 != v1 {
+		t.Error("Touch changed the version")
+	}
+	if d, _ := bucket.TTL("token"); d != NoExpiration {
+		t.Errorf("token TTL %v after Persist", d)
+	}
+	if _, found := bucket.TTL("missing"); found {
+		t.Error("TTL of a missing key")
+	}
+	// times that are not in the future expire the key at once
+	for _, at := range []time.Time{{}, time.Unix(-5, 0), time.Now()} {
+		bucket.Set("past", "p", NoExpiration, true)
+		if !bucket.ExpireAt("past", at) {
+			t.Errorf("ExpireAt(%v) failed", at)
+		}
+		if _, found := bucket.Get("past"); found {
+			t.Errorf("key found after ExpireAt(%v)", at)
+		}
+		if _, _, found := bucket.GetWithExpiration("past"); found {
+			t.Errorf("key found with expiration after ExpireAt(%v)", at)
+		}
+		if _, found := bucket.TTL("past"); found {
+			t.Errorf("TTL found after ExpireAt(%v)", at)
+		}
+	}
+	time.Sleep(150 * time.Millisecond)
+
+	// expiration changes survive a crash
+	recovered, e := newTestCache(t, o).NewBucket("ttl", NoExpiration)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if _, found := recovered.Get("session"); !found {
+		t.Error("touched key expired after a restart")
+	}
+	if d, _ := recovered.TTL("token"); d != NoExpiration {
+		t.Errorf("token TTL %v after a restart", d)
+	}
+	if d, _ := recovered.TTL("deadline"); d <= 0 || d > time.Minute {
+		t.Errorf("deadline TTL %v after a restart", d)
+	}
+	if _, found := recovered.Get("past"); found {
+		t.Error("expired key recovered after a restart")
+	}
+}
+
+func Test_batch(t *testing.T) {
+	t.Parallel()
+	o := testOptions(t)
+	bucket, e := newTestCache(t, o).NewBucket("batch", NoExpiration)
+	if e != nil {
+		t.Fatal(e)
+	}
+	items := map[string]interface{}{"": 0, "nil": nil}
+	for i := 0; i < 1000; i++ {
+		items[strconv.Itoa(i)] = i
+	}
+	results := bucket.SetMany(items, NoExpiration, true)
+	if len(results) != len(items) || results["1"] != nil || results[""] != IllegalParameter || results["nil"] != IllegalParameter {
+		t.Errorf("unexpected results %v %v %v", results["1"], results[""], results["nil"])
+	}
+	values := bucket.GetMany([]string{"1", "999", "missing"})
+	if len(values) != 2 || values["999"] != "999" {
+		t.Errorf("unexpected values %v", values)
+	}
+	deleted := bucket.DeleteMany([]string{"1", "2", "missing"})
+	if !deleted["1"] || !deleted["2"] || deleted["missing"] {
+		t.Errorf("unexpected deletions %v", deleted)
+	}
+	time.Sleep(100 * time.Millisecond)
+	// header, version and one record per batch
+	data, err := os.ReadFile(filepath.Join(o.WorkingFolder, "batch.data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(string(data), "\n"); n != 4 {
+		t.Errorf("%d lines in the working file instead of 4", n)
+	}
+
+	recovered, e := newTestCache(t, o).NewBucket("batch", NoExpiration)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if n := recovered.ItemCount(); n != 998 {
+		t.Errorf("%d items recovered instead of 998", n)
+	}
+	if _, found := recovered.Get("2"); found {
+		t.Error("deleted key recovered")
+	}
+}
+
+func Test_txn(t *testing.T) {
+	t.Parallel()
+	o := testOptions(t)
+	bucket, e := newTestCache(t, o).NewBucketWithOptions("txn", NoExpiration, &BucketOptions{Shards: 4})
+	if e != nil {
+		t.Fatal(e)
+	}
+	bucket.Set("user:1", "ann", NoExpiration, true)
+	bucket.Set("email:ann@example.com", "1", NoExpiration, true)
+	// rename the user and its index key together
+	e = bucket.Txn(func(tx *Tx) error {
+		name, found := tx.Get("user:1")
+		if !found {
+			return errors.New("missing user")
+		}
+		tx.Delete("email:" + name + "@example.com")
+		if err := tx.Set("user:1", "bob", NoExpiration); err != nil {
+			return err
+		}
+		if v, _ := tx.Get("user:1"); v != "bob" {
+			t.Errorf("write not visible in the transaction: %q", v)
+		}
+		return tx.Set("email:bob@example.com", "1", NoExpiration)
+	})
+	if e != nil {
+		t.Fatal(e)
+	}
+	// a failing transaction changes nothing
+	failure := errors.New("abort")
+	if e = bucket.Txn(func(tx *Tx) error {
+		tx.Delete("user:1")
+		return failure
+	}); e != failure {
+		t.Errorf("transaction error not returned: %v", e)
+	}
+	if v, _ := bucket.Get("user:1"); v != "bob" {
+		t.Errorf("user is %q after an aborted transaction", v)
+	}
+	time.Sleep(100 * time.Millisecond)
+	// a commit torn by a crash is ignored
+	f, err := os.OpenFile(filepath.Join(o.WorkingFolder, "txn.data"), os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	line, _ := encodeRecord(FileData{Op: opCommit, Batch: []FileData{{Op: opDelete, Key: "user:1"}, {Op: opDelete, Key: "email:bob@example.com"}}})
+	_, _ = f.Write(line[:len(line)/2])
+	_ = f.Close()
+
+	recovered, e := newTestCache(t, o).NewBucket("txn", NoExpiration)
+	if e != nil {
+		t.Fatal(e)
+	}
+	items := recovered.Items()
+	if len(items) != 2 || items["user:1"] != "bob" || items["email:bob@example.com"] != "1" {
+		t.Errorf("unexpected items after recovery %v", items)
+	}
+}
+
+func Test_scan(t *testing.T) {
+	t.Parallel()
+	for _, ordered := range []bool{true, false} {
+		bucket, e := newTestCache(t, testOptions(t)).NewBucketWithOptions("scan", NoExpiration, &BucketOptions{Shards: 4, Ordered: ordered})
+		if e != nil {
+			t.Fatal(e)
+		}
+		for i := 0; i < 100; i++ {
+			bucket.Set(fmt.Sprintf("user:%02d", i), i, NoExpiration, false)
+			bucket.Set(fmt.Sprintf("item:%02d", i), i, NoExpiration, false)
+		}
+		bucket.Delete("user:50")
+		bucket.Set("user:51", "expired", time.Nanosecond, false)
+		time.Sleep(time.Millisecond)
+		if pairs := bucket.Scan("user:5"); len(pairs) != 8 || pairs[0].Key != "user:52" || pairs[7] != (KeyValue{"user:59", "59"}) {
+			t.Errorf("ordered %v: unexpected scan %v", ordered, pairs)
+		}
+		if pairs := bucket.Range("item:98", "user:02"); len(pairs) != 4 || pairs[2].Key != "user:00" {
+			t.Errorf("ordered %v: unexpected range %v", ordered, pairs)
+		}
+		// pages cover all keys once
+		var keys []string
+		cursor := ""
+		for {
+			page, next := bucket.ScanPage("user:", cursor, 7)
+			for _, kv := range page {
+				keys = append(keys, kv.Key)
+			}
+			if next == "" {
+				break
+			}
+			cursor = next
+		}
+		if len(keys) != 98 || keys[0] != "user:00" || keys[97] != "user:99" {
+			t.Errorf("ordered %v: %d keys in pages", ordered, len(keys))
+		}
+		if keys, e := bucket.Keys("*:[1-2]?"); e != nil || len(keys) != 40 || keys[0] != "item:10" {
+			t.Errorf("ordered %v: unexpected keys %v %v", ordered, keys, e)
+		}
+		if keys, _ := bucket.Keys("user:?[^0-8]"); len(keys) != 10 || keys[9] != "user:99" {
+			t.Errorf("ordered %v: unexpected keys %v", ordered, keys)
+		}
+		if _, e := bucket.Keys("user:[1-"); e != IllegalParameter {
+			t.Errorf("ordered %v: malformed pattern accepted: %v", ordered, e)
+		}
+		bucket.Flush()
+		if pairs := bucket.Scan(""); len(pairs) != 0 {
+			t.Errorf("ordered %v: %d pairs after Flush", ordered, len(pairs))
+		}
+	}
+	if ok, e := Match(`a\*[b-c]?`, "a*cd"); !ok || e != nil {
+		t.Errorf("pattern not matched: %v", e)
+	}
+	if _, e := Match("a[", "a"); e != IllegalParameter {
+		t.Errorf("malformed pattern accepted: %v", e)
+	}
+}
+
+func Test_iterate(t *testing.T) {
+	t.Parallel()
+	bucket, e := newTestCache(t, testOptions(t)).NewBucketWithOptions("iterate", NoExpiration, &BucketOptions{Shards: 4})
+	if e != nil {
+		t.Fatal(e)
+	}
+	for i := 0; i < 100; i++ {
+		bucket.Set(strconv.Itoa(i), i, NoExpiration, false)
+	}
+	bucket.Set("expired", "x", time.Nanosecond, false)
+	time.Sleep(time.Millisecond)
+	sum := 0
+	for k, v := range bucket.All() {
+		if k != v {
+			t.Errorf("%q has value %q", k, v)
+		}
+		n, _ := strconv.Atoi(v)
+		sum += n
+	}
+	if sum != 4950 {
+		t.Errorf("sum of values %d instead of 4950", sum)
+	}
+	visited := 0
+	bucket.ForEach(func(k, v string) bool {
+		visited++
+		return visited < 10
+	})
+	if visited != 10 {
+		t.Errorf("%d pairs visited instead of 10", visited)
+	}
+	// the loop body runs without lock, it neither blocks writers nor deadlocks when writing itself
+	done := make(chan bool)
+	go func() {
+		for k, v := range bucket.All() {
+			written := make(chan bool)
+			go func() {
+				bucket.Set("other", "x", NoExpiration, false)
+				written <- true
+			}()
+			<-written
+			bucket.Set(k, v+"!", NoExpiration, false)
+		}
+		done <- true
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("iteration blocked writes")
+	}
+	if v, _ := bucket.Get("42"); v != "42!" {
+		t.Errorf("value written during the iteration is %q", v)
+	}
+}
+
+func Test_watch(t *testing.T) {
+	t.Parallel()
+	bucket, e := newTestCache(t, testOptions(t)).NewBucketWithOptions("watch", NoExpiration, &BucketOptions{MaxItems: 2})
+	if e != nil {
+		t.Fatal(e)
+	}
+	events, cancel := bucket.Watch("cfg:")
+	bucket.Set("cfg:a", "1", NoExpiration, false)
+	bucket.Set("other", "x", NoExpiration, false)
+	bucket.Set("cfg:a", "2", NoExpiration, false)
+	bucket.Delete("cfg:a")
+	bucket.Set("cfg:b", "3", time.Nanosecond, false)
+	time.Sleep(time.Millisecond)
+	bucket.DeleteExpired()
+	bucket.Delete("other")
+	bucket.Set("cfg:c", "4", NoExpiration, false)
+	bucket.Set("x", "x", NoExpiration, false)
+	bucket.Set("cfg:d", "5", NoExpiration, false)
+	expected := []Event{
+		{Type: EventSet, Key: "cfg:a", New: "1"},
+		{Type: EventUpdate, Key: "cfg:a", Old: "1", New: "2"},
+		{Type: EventDelete, Key: "cfg:a", Old: "2"},
+		{Type: EventSet, Key: "cfg:b", New: "3"},
+		{Type: EventExpire, Key: "cfg:b", Old: "3"},
+		{Type: EventSet, Key: "cfg:c", New: "4"},
+		{Type: EventSet, Key: "cfg:d", New: "5"},
+		{Type: EventEvict, Key: "cfg:c", Old: "4"},
+	}
+	for i, want := range expected {
+		ev := <-events
+		ev.Version = 0
+		if ev != want {
+			t.Errorf("event %d is %+v instead of %+v", i, ev, want)
+		}
+	}
+	cancel()
+	if _, open := <-events; open {
+		t.Error("channel open after cancel")
+	}
+
+	// events of a key are received in order
+	ordered, cancel := bucket.Watch("n")
+	done := make(chan bool)
+	for w := 0; w < 4; w++ {
+		go func() {
+			for i := 0; i < 50; i++ {
+				if _, e := bucket.Increment("n", 1, NoExpiration, false); e != nil {
+					t.Error(e)
+				}
+			}
+			done <- true
+		}()
+	}
+	for w := 0; w < 4; w++ {
+		<-done
+	}
+	var last uint64
+	for i := 0; i < 64 && len(ordered) > 0; i++ {
+		ev := <-ordered
+		if ev.Version <= last {
+			t.Errorf("event version %d after %d", ev.Version, last)
+		}
+		last = ev.Version
+	}
+	cancel()
+
+	// slow consumers
+	dropped, cancel := bucket.WatchWithOptions("slow", &WatchOptions{Buffer: 1})
+	defer cancel()
+	disconnected, _ := bucket.WatchWithOptions("slow", &WatchOptions{Buffer: 1, Policy: WatchDisconnect})
+	blocked, cancelBlocked := bucket.WatchWithOptions("slow", &WatchOptions{Buffer: 1, Policy: WatchBlock})
+	go func() {
+		bucket.Set("slow", "1", NoExpiration, false)
+		bucket.Set("slow", "2", NoExpiration, false)
+		done <- true
+	}()
+	select {
+	case <-done:
+		t.Error("writer not blocked by a full WatchBlock buffer")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if ev := <-blocked; ev.New != "1" {
+		t.Errorf("blocked watcher received %+v", ev)
+	}
+	<-done
+	cancelBlocked()
+	if ev := <-dropped; ev.New != "1" || len(dropped) != 0 {
+		t.Errorf("dropping watcher received %+v", ev)
+	}
+	<-disconnected
+	if _, open := <-disconnected; open {
+		t.Error("slow watcher not disconnected")
+	}
+}
+
+func Test_policies(t *testing.T) {
+	t.Parallel()
+	// every policy must forget its victims and respect the item limit
+	for name, policy := range testPolicies {
+		bucket, e := newTestCache(t, testOptions(t)).NewBucketWithOptions(name, NoExpiration, &BucketOptions{MaxItems: 10, Policy: policy})
+		if e != nil {
+			t.Fatal(e)
+		}
+		for i := 0; i < 100; i++ {
+			k := strconv.Itoa(i % 25)
+			if _, found := bucket.Get(k); !found {
+				bucket.Set(k, k, NoExpiration, false)
+			}
+		}
+		if n := bucket.ItemCount(); n != 10 {
+			t.Errorf("%s: %d items instead of 10", name, n)
+		}
+	}
+	// LFU keeps the most frequently used key even when it is the least recent one
+	bucket, e := newTestCache(t, testOptions(t)).NewBucketWithOptions("lfu", NoExpiration, &BucketOptions{MaxItems: 2, Policy: NewLFU})
+	if e != nil {
+		t.Fatal(e)
+	}
+	bucket.Set("a", "a", NoExpiration, false)
+	bucket.Get("a")
+	bucket.Set("b", "b", NoExpiration, false)
+	bucket.Set("c", "c", NoExpiration, false)
+	if _, found := bucket.Get("a"); !found {
+		t.Error("LFU evicted the most frequently used key")
+	}
+	if _, found := bucket.Get("b"); found {
+		t.Error("LFU kept the least frequently used key")
+	}
+	// every row of a sketch wider than 1<<16 uses all its counters
+	s := newSketch(1 << 18)
+	for row := range s.rows {
+		high := false
+		for i := 0; i < 1000 && !high; i++ {
+			high = s.index(maphash.String(s.seed, strconv.Itoa(i)), row) >= 1<<16
+		}
+		if !high {
+			t.Errorf("row %d of the sketch limited to 16 bits", row)
+		}
+	}
+}
+
+var testPolicies = map[string]PolicyFactory{"lru": NewLRU, "lfu": NewLFU, "arc": NewARC, "tinylfu": NewTinyLFU}
+
+// benchmarkPolicy reports the hit rate of a policy on a Zipfian trace, loading missing keys
+func benchmarkPolicy(b *testing.B, policy PolicyFactory) {
+	bucket, e := newTestCache(b, testOptions(b)).NewBucketWithOptions("zipf", NoExpiration, &BucketOptions{MaxItems: 1000, Policy: policy})
+	if e != nil {
+		b.Fatal(e)
+	}
+	zipf := rand.NewZipf(rand.New(rand.NewSource(1)), 1.1, 1, 100000)
+	hits := 0
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		k := strconv.FormatUint(zipf.Uint64(), 10)
+		if _, found := bucket.Get(k); found {
+			hits++
+		} else {
+			bucket.Set(k, k, NoExpiration, false)
+		}
+	}
+	b.ReportMetric(100*float64(hits)/float64(b.N), "hit%")
+}
+
+// benchmarkShards measures concurrent reads and writes on a bucket with the given number of shards
+func benchmarkShards(b *testing.B, shards int) {
+	bucket, e := newTestCache(b, testOptions(b)).NewBucketWithOptions("shards", NoExpiration, &BucketOptions{Shards: shards})
+	if e != nil {
+		b.Fatal(e)
+	}
+	for i := 0; i < 1000; i++ {
+		bucket.Set(strconv.Itoa(i), i, NoExpiration, false)
+	}
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for i := 0; pb.Next(); i++ {
+			k := strconv.Itoa(i % 1000)
+			if i%10 == 0 {
+				bucket.Set(k, i, NoExpiration, false)
+			} else {
+				bucket.Get(k)
+			}
+		}
+	})
+}
+
+func BenchmarkShards1(b *testing.B)  { benchmarkShards(b, 1) }
+func BenchmarkShards32(b *testing.B) { benchmarkShards(b, 32) }
+
+func BenchmarkPolicyLRU(b *testing.B)     { benchmarkPolicy(b, NewLRU) }
+func BenchmarkPolicyLFU(b *testing.B)     { benchmarkPolicy(b, NewLFU) }
+func BenchmarkPolicyARC(b *testing.B)     { benchmarkPolicy(b, NewARC) }
+func BenchmarkPolicyTinyLFU(b *testing.B) { benchmarkPolicy(b, NewTinyLFU) }
+
+func testOptions(t testing.TB) Options {
+	folder := t.TempDir()
+	return Options{WorkingFolder: folder, RecoveryFolder: folder}
+}
+
+// newTestCache returns a cache that is terminated with the test. Creating a second cache on the
+// same folders while the first is still running simulates a restart after a crash.
+func newTestCache(t testing.TB, o Options) *Cache {
+	t.Helper()
+	c, err := New(&o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = c.Terminate() })
+	return c
+}
@@ -0,0 +1,248 @@
+// Package jachttp exposes the buckets of a jac cache through HTTP
+//
+//	GET    /buckets                          names of the open buckets
+//	GET    /buckets/{name}/stats             number of items and recovery report
+//	POST   /buckets/{name}/compact           compaction of the working file
+//	GET    /buckets/{name}/keys?prefix=p     key/value pairs starting with p (cursor and limit for pages)
+//	GET    /buckets/{name}/keys/{key}        value, with its time to live and version in headers
+//	PUT    /buckets/{name}/keys/{key}        writes the body, with the TTL header as expiration time
+//	DELETE /buckets/{name}/keys/{key}        deletes the key
+package jachttp
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/fpessolano/jac"
+)
+
+// headers
+const (
+	// Time to live in seconds (or as a Go duration when writing), absent for keys without expiration
+	HeaderTTL = "X-Jac-TTL"
+	// Version of the value read
+	HeaderVersion = "X-Jac-Version"
+	// "false" to write a value in memory only
+	HeaderPersist = "X-Jac-Persist"
+)
+
+// default maximum size of a value written with PUT
+const defaultMaxValueBytes = 1 << 20
+
+// Middleware wraps the handler of every request, for instance to authenticate it
+type Middleware func(http.Handler) http.Handler
+
+// Options are the optional settings of a handler
+type Options struct {
+	Auth          Middleware // Authentication of the requests. nil for none
+	MaxValueBytes int64      // Maximum size of a value written with PUT. 0 for 1MiB
+}
+
+type handler struct {
+	cache    *jac.Cache
+	maxValue int64
+}
+
+type bucketStats struct {
+	Items    int            `json:"items"`
+	Recovery recoveryReport `json:"recovery"`
+}
+
+type recoveryReport struct {
+	Source    string `json:"source,omitempty"`
+	Version   int    `json:"version"`
+	Recovered int    `json:"recovered"`
+	Discarded int    `json:"discarded"`
+	Err       string `json:"error,omitempty"`
+}
+
+type keyValue struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+type scanPage struct {
+	Items []keyValue `json:"items"`
+	Next  string     `json:"next,omitempty"`
+}
+
+// New returns a handler serving the buckets of cache c with options o, nil for none
+func New(c *jac.Cache, o *Options) http.Handler {
+	if o == nil {
+		o = &Options{}
+	}
+	h := &handler{
+		cache:    c,
+		maxValue: o.MaxValueBytes,
+	}
+	if h.maxValue <= 0 {
+		h.maxValue = defaultMaxValueBytes
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /buckets", h.buckets)
+	mux.HandleFunc("GET /buckets/{name}/stats", h.stats)
+	mux.HandleFunc("GET /buckets/{name}/keys", h.scan)
+	mux.HandleFunc("GET /buckets/{name}/keys/{key...}", h.get)
+	mux.HandleFunc("POST /buckets/{name}/compact", h.compact)
+	mux.HandleFunc("PUT /buckets/{name}/keys/{key...}", h.put)
+	mux.HandleFunc("DELETE /buckets/{name}/keys/{key...}", h.delete)
+	if o.Auth != nil {
+		return o.Auth(mux)
+	}
+	return mux
+}
+
+func (h *handler) buckets(w http.ResponseWriter, r *http.Request) {
+	reply(w, h.cache.Buckets())
+}
+
+func (h *handler) stats(w http.ResponseWriter, r *http.Request) {
+	b, ok := h.bucket(w, r)
+	if !ok {
+		return
+	}
+	report := b.Recovery()
+	stats := bucketStats{
+		Items: b.ItemCount(),
+		Recovery: recoveryReport{
+			Source:    report.Source,
+			Version:   report.Version,
+			Recovered: report.Recovered,
+			Discarded: report.Discarded,
+		},
+	}
+	if report.Err != nil {
+		stats.Recovery.Err = report.Err.Error()
+	}
+	reply(w, stats)
+}
+
+func (h *handler) compact(w http.ResponseWriter, r *http.Request) {
+	b, ok := h.bucket(w, r)
+	if !ok {
+		return
+	}
+	b.Compact()
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (h *handler) scan(w http.ResponseWriter, r *http.Request) {
+	b, ok := h.bucket(w, r)
+	if !ok {
+		return
+	}
+	q := r.URL.Query()
+	limit := 0
+	if l := q.Get("limit"); l != "" {
+		var err error
+		if limit, err = strconv.Atoi(l); err != nil || limit < 0 {
+			http.Error(w, "illegal limit", http.StatusBadRequest)
+			return
+		}
+	}
+	pairs, next := b.ScanPage(q.Get("prefix"), q.Get("cursor"), limit)
+	page := scanPage{Items: make([]keyValue, len(pairs)), Next: next}
+	for i, p := range pairs {
+		page.Items[i] = keyValue{p.Key, p.Value}
+	}
+	reply(w, page)
+}
+
+func (h *handler) get(w http.ResponseWriter, r *http.Request) {
+	b, ok := h.bucket(w, r)
+	if !ok {
+		return
+	}
+	k := r.PathValue("key")
+	v, version, found := b.GetWithVersion(k)
+	if !found {
+		http.Error(w, "key not found", http.StatusNotFound)
+		return
+	}
+	if ttl, found := b.TTL(k); found && ttl != jac.NoExpiration {
+		w.Header().Set(HeaderTTL, strconv.FormatInt(int64(math.Ceil(ttl.Seconds())), 10))
+	}
+	w.Header().Set(HeaderVersion, strconv.FormatUint(version, 10))
+	w.Header().Set("Content-Type", "application/octet-stream")
+	_, _ = io.WriteString(w, v)
+}
+
+func (h *handler) put(w http.ResponseWriter, r *http.Request) {
+	b, ok := h.bucket(w, r)
+	if !ok {
+		return
+	}
+	ttl, err := parseTTL(r.Header.Get(HeaderTTL))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	pers := true
+	if p := r.Header.Get(HeaderPersist); p != "" {
+		if pers, err = strconv.ParseBool(p); err != nil {
+			http.Error(w, "illegal "+HeaderPersist, http.StatusBadRequest)
+			return
+		}
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, h.maxValue))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, "value too large", http.StatusRequestEntityTooLarge)
+		} else {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		}
+		return
+	}
+	switch err := b.SetE(r.PathValue("key"), string(body), ttl, pers); {
+	case errors.Is(err, jac.IllegalParameter):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case err != nil:
+		// the value is set in memory only
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+	default:
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (h *handler) delete(w http.ResponseWriter, r *http.Request) {
+	b, ok := h.bucket(w, r)
+	if !ok {
+		return
+	}
+	b.Delete(r.PathValue("key"))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// bucket returns the bucket named in the request path, replying 404 if it is not open
+func (h *handler) bucket(w http.ResponseWriter, r *http.Request) (*jac.Bucket, bool) {
+	b, found := h.cache.Bucket(r.PathValue("name"))
+	if !found {
+		http.Error(w, jac.BucketNotOpen.Error(), http.StatusNotFound)
+	}
+	return b, found
+}
+
+// parseTTL reads an expiration time given in seconds or as a Go duration, empty for the bucket default
+func parseTTL(s string) (time.Duration, error) {
+	if s == "" {
+		return jac.DefaultExpiration, nil
+	}
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil && n > 0 {
+		return time.Duration(n) * time.Second, nil
+	}
+	if d, err := time.ParseDuration(s); err == nil && d > 0 {
+		return d, nil
+	}
+	return 0, errors.New("illegal " + HeaderTTL + ": " + s)
+}
+
+func reply(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
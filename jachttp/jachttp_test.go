@@ -0,0 +1,116 @@
+package jachttp
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/fpessolano/jac"
+)
+
+func Test_handler(t *testing.T) {
+	folder := t.TempDir()
+	cache, err := jac.New(&jac.Options{WorkingFolder: folder, RecoveryFolder: folder})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = cache.Terminate() })
+	if _, err := cache.NewBucket("ops", jac.NoExpiration); err != nil {
+		t.Fatal(err)
+	}
+	auth := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Authorization") != "Bearer secret" {
+				http.Error(w, "unauthorised", http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+	server := httptest.NewServer(New(cache, &Options{Auth: auth, MaxValueBytes: 16}))
+	defer server.Close()
+
+	do := func(method, path, body string, header map[string]string) (*http.Response, string) {
+		t.Helper()
+		req, err := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer secret")
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		rsp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rsp.Body.Close()
+		b, _ := io.ReadAll(rsp.Body)
+		return rsp, string(b)
+	}
+
+	if rsp, err := http.Get(server.URL + "/buckets"); err != nil || rsp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("request without credentials not rejected: %v", rsp.Status)
+	}
+	if _, body := do("GET", "/buckets", "", nil); strings.TrimSpace(body) != `["ops"]` {
+		t.Errorf("bucket list %v", body)
+	}
+	if rsp, _ := do("PUT", "/buckets/ops/keys/user/1", "alice", map[string]string{HeaderTTL: "1m"}); rsp.StatusCode != http.StatusNoContent {
+		t.Errorf("put returned %v", rsp.Status)
+	}
+	do("PUT", "/buckets/ops/keys/user/2", "bob", nil)
+	rsp, body := do("GET", "/buckets/ops/keys/user/1", "", nil)
+	if rsp.StatusCode != http.StatusOK || body != "alice" || rsp.Header.Get(HeaderTTL) != "60" || rsp.Header.Get(HeaderVersion) == "" {
+		t.Errorf("get returned %v %q %v", rsp.Status, body, rsp.Header)
+	}
+	if rsp, _ := do("GET", "/buckets/ops/keys/user/2", "", nil); rsp.Header.Get(HeaderTTL) != "" {
+		t.Errorf("TTL given for a key without expiration: %v", rsp.Header.Get(HeaderTTL))
+	}
+	for _, c := range []struct {
+		method, path, body string
+		header             map[string]string
+		status             int
+	}{
+		{"PUT", "/buckets/ops/keys/k", "v", map[string]string{HeaderTTL: "soon"}, http.StatusBadRequest},
+		{"PUT", "/buckets/ops/keys/k", "v", map[string]string{HeaderPersist: "maybe"}, http.StatusBadRequest},
+		{"PUT", "/buckets/ops/keys/k", strings.Repeat("v", 17), nil, http.StatusRequestEntityTooLarge},
+		{"GET", "/buckets/ops/keys/missing", "", nil, http.StatusNotFound},
+		{"GET", "/buckets/missing/keys/k", "", nil, http.StatusNotFound},
+		{"GET", "/buckets/ops/keys?limit=x", "", nil, http.StatusBadRequest},
+		{"POST", "/buckets/ops/compact", "", nil, http.StatusAccepted},
+	} {
+		if rsp, body := do(c.method, c.path, c.body, c.header); rsp.StatusCode != c.status {
+			t.Errorf("%v %v returned %v instead of %v: %v", c.method, c.path, rsp.Status, c.status, body)
+		}
+	}
+
+	var page struct {
+		Items []struct{ Key, Value string }
+		Next  string
+	}
+	_, body = do("GET", "/buckets/ops/keys?prefix=user/&limit=1", "", nil)
+	if err := json.Unmarshal([]byte(body), &page); err != nil || len(page.Items) != 1 || page.Items[0].Key != "user/1" || page.Next != "user/1" {
+		t.Errorf("first page %v", body)
+	}
+	cursor := page.Next
+	page.Next = ""
+	_, body = do("GET", "/buckets/ops/keys?prefix=user/&limit=1&cursor="+cursor, "", nil)
+	if err := json.Unmarshal([]byte(body), &page); err != nil || len(page.Items) != 1 || page.Items[0].Value != "bob" || page.Next != "" {
+		t.Errorf("last page %v", body)
+	}
+
+	if rsp, _ := do("DELETE", "/buckets/ops/keys/user/1", "", nil); rsp.StatusCode != http.StatusNoContent {
+		t.Errorf("delete returned %v", rsp.Status)
+	}
+	var stats struct {
+		Items    int
+		Recovery struct{ Recovered int }
+	}
+	_, body = do("GET", "/buckets/ops/stats", "", nil)
+	if err := json.Unmarshal([]byte(body), &stats); err != nil || stats.Items != 1 {
+		t.Errorf("stats %v", body)
+	}
+}
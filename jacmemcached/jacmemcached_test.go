@@ -0,0 +1,195 @@
+package jacmemcached
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fpessolano/jac"
+)
+
+func newTestServer(t *testing.T, o *Options) (*jac.Cache, *Server, string) {
+	folder := t.TempDir()
+	cache, err := jac.New(&jac.Options{WorkingFolder: folder, RecoveryFolder: folder})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = cache.Terminate() })
+	for _, name := range []string{"legacy", "other"} {
+		if _, err := cache.NewBucket(name, jac.NoExpiration); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s, err := New(cache, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() { _ = s.Serve(l) }()
+	t.Cleanup(func() { _ = s.Close() })
+	return cache, s, l.Addr().String()
+}
+
+// session sends requests and reads their replies up to a final line
+type session struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func dial(t *testing.T, address string) *session {
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	return &session{t: t, conn: conn, r: bufio.NewReader(conn)}
+}
+
+// do sends a request and returns the reply lines joined by |
+func (s *session) do(request string) string {
+	s.t.Helper()
+	if _, err := s.conn.Write([]byte(request)); err != nil {
+		s.t.Fatal(err)
+	}
+	var lines []string
+	for {
+		_ = s.conn.SetReadDeadline(time.Now().Add(time.Second))
+		line, err := s.r.ReadString('\n')
+		if err != nil {
+			s.t.Fatalf("%q: %v after %v", request, err, lines)
+		}
+		line = strings.TrimSuffix(line, "\r\n")
+		lines = append(lines, line)
+		if !strings.HasPrefix(line, "VALUE ") && !strings.HasPrefix(line, "STAT ") &&
+			(len(lines) < 2 || !strings.HasPrefix(lines[len(lines)-2], "VALUE ")) {
+			return strings.Join(lines, "|")
+		}
+	}
+}
+
+func Test_commands(t *testing.T) {
+	cache, _, address := newTestServer(t, &Options{Bucket: "legacy", MaxValueBytes: 16})
+	c := dial(t, address)
+	for _, step := range []struct{ request, reply string }{
+		{"set a 0 0 5\r\nhello\r\n", "STORED"},
+		{"get a\r\n", "VALUE a 0 5|hello|END"},
+		{"set b 42 0 3\r\nbin\r\n", "STORED"},
+		{"get a b missing\r\n", "VALUE a 0 5|hello|VALUE b 42 3|bin|END"},
+		{"add a 0 0 1\r\nx\r\n", "NOT_STORED"},
+		{"add c 0 0 1\r\n5\r\n", "STORED"},
+		{"replace missing 0 0 1\r\nx\r\n", "NOT_STORED"},
+		{"replace a 0 0 5\r\nworld\r\n", "STORED"},
+		{"incr c 10\r\n", "15"},
+		{"decr c 20\r\n", "0"},
+		{"incr a 1\r\n", "CLIENT_ERROR cannot increment or decrement non-numeric value"},
+		{"incr missing 1\r\n", "NOT_FOUND"},
+		{"cas a 0 0 1 1\r\nx\r\n", "EXISTS"},
+		{"cas missing 0 0 1 1\r\nx\r\n", "NOT_FOUND"},
+		{"touch a 100\r\n", "TOUCHED"},
+		{"touch missing 100\r\n", "NOT_FOUND"},
+		{"delete b\r\n", "DELETED"},
+		{"delete b\r\n", "NOT_FOUND"},
+		{"set big 0 0 17\r\n" + strings.Repeat("x", 17) + "\r\n", "SERVER_ERROR object too large for cache"},
+		{"set bad 0 0 2\r\nabc\r\n", "CLIENT_ERROR bad data chunk"},
+		// the rest of the bad chunk is read as a command
+		{"", "ERROR"},
+		{"set a 0 0\r\n", "ERROR"},
+		{"set d 0 0 1 noreply\r\nx\r\nget d\r\n", "VALUE d 0 1|x|END"},
+		{"set e 0 -1 1\r\nx\r\n", "STORED"},
+		{"get e\r\n", "END"},
+		{"bogus\r\n", "ERROR"},
+		{"version\r\n", "VERSION jac"},
+	} {
+		if reply := c.do(step.request); reply != step.reply {
+			t.Errorf("%q returned %q instead of %q", step.request, reply, step.reply)
+		}
+	}
+
+	// cas with the unique returned by gets
+	reply := c.do("gets a\r\n")
+	fields := strings.Fields(strings.Split(reply, "|")[0])
+	if len(fields) != 5 {
+		t.Fatalf("gets returned %q", reply)
+	}
+	if r := c.do("cas a 7 0 3 " + fields[4] + "\r\nnew\r\n"); r != "STORED" {
+		t.Errorf("cas returned %q", r)
+	}
+	if r := c.do("cas a 7 0 3 " + fields[4] + "\r\nold\r\n"); r != "EXISTS" {
+		t.Errorf("cas with an old unique returned %q", r)
+	}
+	if r := c.do("get a\r\n"); r != "VALUE a 7 3|new|END" {
+		t.Errorf("get after cas returned %q", r)
+	}
+	if ttl, _ := mustBucket(t, cache, "legacy").TTL("a"); ttl != jac.NoExpiration {
+		t.Errorf("expiration time kept by cas: %v", ttl)
+	}
+
+	if r := c.do("stats\r\n"); !strings.Contains(r, "STAT curr_items ") || !strings.HasSuffix(r, "|END") {
+		t.Errorf("stats returned %q", r)
+	}
+	if r := c.do("flush_all\r\n"); r != "OK" {
+		t.Errorf("flush_all returned %q", r)
+	}
+	if n := mustBucket(t, cache, "legacy").ItemCount(); n != 0 {
+		t.Errorf("%d items after flush_all", n)
+	}
+}
+
+func Test_flushDelay(t *testing.T) {
+	cache, s, address := newTestServer(t, &Options{Bucket: "legacy"})
+	c := dial(t, address)
+	bucket := mustBucket(t, cache, "legacy")
+	// delays over 30 days are Unix times
+	c.do("set a 0 0 1\r\n1\r\n")
+	if r := c.do(fmt.Sprintf("flush_all %d\r\n", time.Now().Unix()-10)); r != "OK" {
+		t.Errorf("flush_all returned %q", r)
+	}
+	if n := bucket.ItemCount(); n != 0 {
+		t.Errorf("%d items after flush_all at a past time", n)
+	}
+	c.do("set a 0 0 1\r\n1\r\n")
+	c.do(fmt.Sprintf("flush_all %d\r\n", time.Now().Unix()+3600))
+	c.do("flush_all 1\r\n")
+	if n := bucket.ItemCount(); n != 1 {
+		t.Errorf("%d items after delayed flush_all", n)
+	}
+	// Close cancels the flushes not run yet
+	_ = s.Close()
+	time.Sleep(1500 * time.Millisecond)
+	if n := bucket.ItemCount(); n != 1 {
+		t.Errorf("%d items after flush_all delayed beyond Close", n)
+	}
+}
+
+func Test_bucketOf(t *testing.T) {
+	var calls int
+	cache, _, address := newTestServer(t, &Options{BucketOf: func(net.Conn) string {
+		calls++
+		return "other"
+	}})
+	if r := dial(t, address).do("set k 0 0 1\r\nv\r\n"); r != "STORED" {
+		t.Errorf("set returned %q", r)
+	}
+	if v, found := mustBucket(t, cache, "other").Get("k"); !found || v != "v" || calls != 1 {
+		t.Errorf("value not written to the bucket of the connection: %q", v)
+	}
+	if _, err := New(cache, &Options{}); err != NoBucket {
+		t.Errorf("server without bucket created: %v", err)
+	}
+}
+
+func mustBucket(t *testing.T, cache *jac.Cache, name string) *jac.Bucket {
+	t.Helper()
+	b, found := cache.Bucket(name)
+	if !found {
+		t.Fatalf("bucket %v not open", name)
+	}
+	return b
+}
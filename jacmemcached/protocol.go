@@ -0,0 +1,486 @@
+package jacmemcached
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fpessolano/jac"
+)
+
+// protocol limits
+const (
+	maxKeyBytes  = 250
+	maxLineBytes = 64 << 10
+	// expiration times up to 30 days are relative, larger ones are Unix times
+	maxRelative = 30 * 24 * 60 * 60
+)
+
+// conn is the state of a client connection
+type conn struct {
+	s       *Server
+	bucket  string
+	r       *bufio.Reader
+	w       *bufio.Writer
+	noreply bool // the current command has no reply
+}
+
+// serve runs a request, it returns true when the client quits and an error when the connection
+// cannot be used any longer
+func (c *conn) serve() (bool, error) {
+	line, err := c.readLine()
+	if err != nil {
+		if errors.Is(err, errLineTooLong) {
+			c.reply("CLIENT_ERROR line too long")
+		}
+		return false, err
+	}
+	f := strings.Fields(line)
+	if len(f) == 0 {
+		c.reply("ERROR")
+		return false, nil
+	}
+	c.noreply = false
+	switch f[0] {
+	case "get", "gets":
+		c.get(f)
+	case "set", "add", "replace", "cas":
+		return false, c.store(f)
+	case "delete":
+		c.delete(f)
+	case "incr", "decr":
+		c.incr(f)
+	case "touch":
+		c.touch(f)
+	case "flush_all":
+		c.flush(f)
+	case "stats":
+		c.stats(f)
+	case "version":
+		c.reply("VERSION jac")
+	case "verbosity":
+		c.noreply = f[len(f)-1] == "noreply"
+		c.reply("OK")
+	case "quit":
+		return true, nil
+	default:
+		c.reply("ERROR")
+	}
+	return false, nil
+}
+
+// get sends the values of the keys found, gets with their cas unique
+func (c *conn) get(f []string) {
+	keys := f[1:]
+	if len(keys) == 0 {
+		c.reply("ERROR")
+		return
+	}
+	for _, k := range keys {
+		if !validKey(k) {
+			c.reply("CLIENT_ERROR bad command line format")
+			return
+		}
+	}
+	b, ok := c.open()
+	if !ok {
+		return
+	}
+	c.s.stats.gets.Add(int64(len(keys)))
+	var values map[string]string
+	if f[0] == "get" {
+		values = b.GetMany(keys)
+	}
+	for _, k := range keys {
+		var v, unique string
+		found := false
+		if values != nil {
+			v, found = values[k]
+		} else {
+			var version uint64
+			if v, version, found = b.GetWithVersion(k); found {
+				unique = " " + strconv.FormatUint(version, 10)
+			}
+		}
+		if !found {
+			c.s.stats.misses.Add(1)
+			continue
+		}
+		c.s.stats.hits.Add(1)
+		flags, data := decode(v)
+		c.reply("VALUE " + k + " " + strconv.FormatUint(uint64(flags), 10) + " " + strconv.Itoa(len(data)) + unique)
+		c.reply(data)
+	}
+	c.reply("END")
+}
+
+// store runs set, add, replace and cas: <command> <key> <flags> <exptime> <bytes> [<cas unique>] [noreply].
+// It returns an error when the data block cannot be read.
+func (c *conn) store(f []string) error {
+	n := 5
+	if f[0] == "cas" {
+		n = 6
+	}
+	if len(f) == n+1 && f[n] == "noreply" {
+		c.noreply = true
+	} else if len(f) != n {
+		c.reply("ERROR")
+		return nil
+	}
+	flags, err1 := strconv.ParseUint(f[2], 10, 32)
+	exptime, err2 := strconv.ParseInt(f[3], 10, 64)
+	size, err3 := strconv.Atoi(f[4])
+	var unique uint64
+	var err4 error
+	if f[0] == "cas" {
+		unique, err4 = strconv.ParseUint(f[5], 10, 64)
+	}
+	if !validKey(f[1]) || err1 != nil || err2 != nil || err3 != nil || err4 != nil || size < 0 {
+		c.reply("CLIENT_ERROR bad command line format")
+		return nil
+	}
+	if size > c.s.options.MaxValueBytes {
+		// the data block is discarded
+		if _, err := c.r.Discard(size + 2); err != nil {
+			return err
+		}
+		c.reply("SERVER_ERROR object too large for cache")
+		return nil
+	}
+	data := make([]byte, size+2)
+	if _, err := io.ReadFull(c.r, data); err != nil {
+		return err
+	}
+	if data[size] != '\r' || data[size+1] != '\n' {
+		c.reply("CLIENT_ERROR bad data chunk")
+		return nil
+	}
+	b, ok := c.open()
+	if !ok {
+		return nil
+	}
+	c.s.stats.sets.Add(1)
+	k, v, ttl := f[1], encode(uint32(flags), string(data[:size])), duration(expiration(exptime))
+	pers := !c.s.options.Volatile
+	switch f[0] {
+	case "set":
+		if err := b.SetE(k, v, ttl, pers); err != nil {
+			c.reply("SERVER_ERROR " + err.Error())
+			return nil
+		}
+	case "add":
+		// version 0 is only matched by a missing key
+		if _, ok := b.CompareAndSwap(k, 0, v, ttl, pers); !ok {
+			c.reply("NOT_STORED")
+			return nil
+		}
+	case "replace":
+		for {
+			_, version, found := b.GetWithVersion(k)
+			if !found {
+				c.reply("NOT_STORED")
+				return nil
+			}
+			if _, ok := b.CompareAndSwap(k, version, v, ttl, pers); ok {
+				break
+			}
+		}
+	case "cas":
+		current, ok := uint64(0), false
+		if unique != 0 {
+			current, ok = b.CompareAndSwap(k, unique, v, ttl, pers)
+		} else if _, current, ok = b.GetWithVersion(k); ok {
+			// no value has version 0
+			ok = false
+		}
+		switch {
+		case current == 0 && !ok:
+			c.reply("NOT_FOUND")
+			return nil
+		case !ok:
+			c.reply("EXISTS")
+			return nil
+		}
+	}
+	c.reply("STORED")
+	return nil
+}
+
+// delete runs delete <key> [0] [noreply], the 0 being sent by old clients
+func (c *conn) delete(f []string) {
+	f = c.options(f)
+	if len(f) == 3 && f[2] == "0" {
+		f = f[:2]
+	}
+	if len(f) != 2 || !validKey(f[1]) {
+		c.reply("CLIENT_ERROR bad command line format.  Usage: delete <key> [noreply]")
+		return
+	}
+	b, ok := c.open()
+	if !ok {
+		return
+	}
+	if b.DeleteMany([]string{f[1]})[f[1]] {
+		c.reply("DELETED")
+	} else {
+		c.reply("NOT_FOUND")
+	}
+}
+
+// incr runs incr and decr <key> <delta> [noreply] on decimal values: incr wraps around at 2^64 and
+// decr stops at 0. The flags and expiration time of the value are kept.
+func (c *conn) incr(f []string) {
+	f = c.options(f)
+	if len(f) != 3 || !validKey(f[1]) {
+		c.reply("ERROR")
+		return
+	}
+	delta, err := strconv.ParseUint(f[2], 10, 64)
+	if err != nil {
+		c.reply("CLIENT_ERROR invalid numeric delta argument")
+		return
+	}
+	b, ok := c.open()
+	if !ok {
+		return
+	}
+	k := f[1]
+	for {
+		v, version, found := b.GetWithVersion(k)
+		if !found {
+			c.reply("NOT_FOUND")
+			return
+		}
+		flags, data := decode(v)
+		n, err := strconv.ParseUint(data, 10, 64)
+		if err != nil {
+			c.reply("CLIENT_ERROR cannot increment or decrement non-numeric value")
+			return
+		}
+		switch {
+		case f[0] == "incr":
+			n += delta
+		case n > delta:
+			n -= delta
+		default:
+			n = 0
+		}
+		ttl, found := b.TTL(k)
+		if !found {
+			continue
+		}
+		if ttl != jac.NoExpiration {
+			ttl = max(ttl, time.Nanosecond)
+		}
+		result := strconv.FormatUint(n, 10)
+		if _, ok := b.CompareAndSwap(k, version, encode(flags, result), ttl, !c.s.options.Volatile); ok {
+			c.reply(result)
+			return
+		}
+	}
+}
+
+// touch runs touch <key> <exptime> [noreply]
+func (c *conn) touch(f []string) {
+	f = c.options(f)
+	if len(f) != 3 || !validKey(f[1]) {
+		c.reply("ERROR")
+		return
+	}
+	exptime, err := strconv.ParseInt(f[2], 10, 64)
+	if err != nil {
+		c.reply("CLIENT_ERROR invalid exptime argument")
+		return
+	}
+	b, ok := c.open()
+	if !ok {
+		return
+	}
+	c.s.stats.touches.Add(1)
+	var touched bool
+	if t := expiration(exptime); t.IsZero() {
+		touched = b.Persist(f[1])
+	} else {
+		touched = b.ExpireAt(f[1], t)
+	}
+	if touched {
+		c.reply("TOUCHED")
+	} else {
+		c.reply("NOT_FOUND")
+	}
+}
+
+// flush runs flush_all [delay] [noreply]
+func (c *conn) flush(f []string) {
+	f = c.options(f)
+	var delay int64
+	if len(f) == 2 {
+		var err error
+		if delay, err = strconv.ParseInt(f[1], 10, 64); err != nil || delay < 0 {
+			c.reply("CLIENT_ERROR bad command line format")
+			return
+		}
+	} else if len(f) != 1 {
+		c.reply("ERROR")
+		return
+	}
+	b, ok := c.open()
+	if !ok {
+		return
+	}
+	c.s.stats.flushes.Add(1)
+	// as exptime, delays over 30 days are Unix times
+	if d := time.Until(expiration(delay)); delay > 0 && d > 0 {
+		c.s.flushAfter(b, d)
+	} else {
+		b.Flush()
+	}
+	c.reply("OK")
+}
+
+// stats returns the general statistics, other groups are not supported
+func (c *conn) stats(f []string) {
+	if len(f) != 1 {
+		c.reply("ERROR")
+		return
+	}
+	b, ok := c.open()
+	if !ok {
+		return
+	}
+	s := c.s
+	now := time.Now()
+	for _, stat := range []struct {
+		name  string
+		value int64
+	}{
+		{"pid", int64(os.Getpid())},
+		{"uptime", int64(now.Sub(s.started) / time.Second)},
+		{"time", now.Unix()},
+		{"curr_connections", int64(s.connections())},
+		{"total_connections", s.stats.connections.Load()},
+		{"cmd_get", s.stats.gets.Load()},
+		{"cmd_set", s.stats.sets.Load()},
+		{"cmd_touch", s.stats.touches.Load()},
+		{"cmd_flush", s.stats.flushes.Load()},
+		{"get_hits", s.stats.hits.Load()},
+		{"get_misses", s.stats.misses.Load()},
+		{"curr_items", int64(b.ItemCount())},
+	} {
+		c.reply("STAT " + stat.name + " " + strconv.FormatInt(stat.value, 10))
+	}
+	c.reply("STAT version jac")
+	c.reply("END")
+}
+
+// options removes a trailing noreply from the fields of a command
+func (c *conn) options(f []string) []string {
+	if len(f) > 1 && f[len(f)-1] == "noreply" {
+		c.noreply = true
+		return f[:len(f)-1]
+	}
+	return f
+}
+
+// open returns the bucket of the connection, replying with an error when it is not open
+func (c *conn) open() (*jac.Bucket, bool) {
+	b, found := c.s.cache.Bucket(c.bucket)
+	if !found {
+		c.reply("SERVER_ERROR " + jac.BucketNotOpen.Error())
+	}
+	return b, found
+}
+
+// reply sends a line unless the command has noreply
+func (c *conn) reply(line string) {
+	if c.noreply {
+		return
+	}
+	c.w.WriteString(line)
+	c.w.WriteString("\r\n")
+}
+
+var errLineTooLong = errors.New("line too long")
+
+// readLine reads a command line without its terminator (CRLF, or LF for telnet)
+func (c *conn) readLine() (string, error) {
+	var line []byte
+	for {
+		part, isPrefix, err := c.r.ReadLine()
+		if err != nil {
+			return "", err
+		}
+		line = append(line, part...)
+		if len(line) > maxLineBytes {
+			return "", errLineTooLong
+		}
+		if !isPrefix {
+			return string(line), nil
+		}
+	}
+}
+
+// validKey checks the length of a key, fields cannot contain spaces
+func validKey(k string) bool {
+	if len(k) == 0 || len(k) > maxKeyBytes {
+		return false
+	}
+	for i := 0; i < len(k); i++ {
+		if k[i] < ' ' || k[i] == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// expiration converts a memcached expiration time into an absolute time, the zero time for none.
+// Negative times are in the past.
+func expiration(exptime int64) time.Time {
+	switch {
+	case exptime == 0:
+		return time.Time{}
+	case exptime < 0:
+		return time.Unix(0, 1)
+	case exptime <= maxRelative:
+		return time.Now().Add(time.Duration(exptime) * time.Second)
+	}
+	return time.Unix(exptime, 0)
+}
+
+// duration converts an absolute expiration time into the duration given to the bucket, values
+// expiring immediately being given a nanosecond
+func duration(t time.Time) time.Duration {
+	if t.IsZero() {
+		return jac.NoExpiration
+	}
+	return max(time.Until(t), time.Nanosecond)
+}
+
+// encode adds non-zero flags to a value. Values starting with a null byte are always given their
+// flags so that they are not mistaken for encoded ones.
+func encode(flags uint32, data string) string {
+	if flags == 0 && !strings.HasPrefix(data, "\x00") {
+		return data
+	}
+	return "\x00" + strconv.FormatUint(uint64(flags), 10) + "\x00" + data
+}
+
+// decode returns the flags and data of a value written by encode
+func decode(v string) (uint32, string) {
+	if !strings.HasPrefix(v, "\x00") {
+		return 0, v
+	}
+	i := strings.IndexByte(v[1:], 0)
+	if i < 0 {
+		return 0, v
+	}
+	flags, err := strconv.ParseUint(v[1:1+i], 10, 32)
+	if err != nil {
+		return 0, v
+	}
+	return uint32(flags), v[i+2:]
+}
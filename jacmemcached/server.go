@@ -0,0 +1,219 @@
+// Package jacmemcached serves a jac bucket to memcached clients with the memcached text protocol:
+// get, gets, set, add, replace, cas, incr, decr, delete, touch, flush_all, stats, version and quit.
+//
+// Values written with non-zero client flags are stored in the bucket as "\x00<flags>\x00<data>" so
+// that the flags survive a restart, other values are stored as they are. The cas unique of a value
+// is its version in the bucket.
+package jacmemcached
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fpessolano/jac"
+)
+
+var (
+	ServerClosed = errors.New("server closed")
+	NoBucket     = errors.New("no bucket given")
+)
+
+// default maximum size of a value
+const defaultMaxValueBytes = 1 << 20
+
+// Options are the settings of a server
+type Options struct {
+	Bucket        string                // Bucket of the connections
+	BucketOf      func(net.Conn) string // Bucket of a connection, for instance chosen by its local address. Overrides Bucket when not nil
+	MaxValueBytes int                   // Maximum size of a value. 0 for 1MiB
+	Volatile      bool                  // Writes are kept in memory only instead of being recorded in the working file
+}
+
+// Server answers the requests of memcached clients with the buckets of a cache
+type Server struct {
+	cache     *jac.Cache
+	options   Options
+	started   time.Time
+	stats     stats
+	mu        sync.Mutex
+	listeners map[net.Listener]bool
+	conns     map[net.Conn]bool
+	flushes   map[*time.Timer]bool // delayed flush_all, stopped by Close
+	closed    bool
+	wg        sync.WaitGroup
+}
+
+// stats are the counters returned by the stats command
+type stats struct {
+	connections atomic.Int64 // total
+	gets        atomic.Int64
+	sets        atomic.Int64
+	hits        atomic.Int64
+	misses      atomic.Int64
+	touches     atomic.Int64
+	flushes     atomic.Int64
+}
+
+// New returns a server for the buckets of cache c. The bucket of a connection is looked up by name
+//  for every request, so it can be opened and closed while the server is running.
+func New(c *jac.Cache, o *Options) (*Server, error) {
+	if o == nil || (o.Bucket == "" && o.BucketOf == nil) {
+		return nil, NoBucket
+	}
+	if o.MaxValueBytes < 0 {
+		return nil, jac.IllegalParameter
+	}
+	s := &Server{
+		cache:     c,
+		options:   *o,
+		started:   time.Now(),
+		listeners: make(map[net.Listener]bool),
+		conns:     make(map[net.Conn]bool),
+		flushes:   make(map[*time.Timer]bool),
+	}
+	if s.options.MaxValueBytes == 0 {
+		s.options.MaxValueBytes = defaultMaxValueBytes
+	}
+	return s, nil
+}
+
+// ListenAndServe listens on a TCP address ("tcp") or Unix socket path ("unix") and serves the
+//  connections until Close is called, when it returns ServerClosed. An existing Unix socket file
+//  is replaced.
+func (s *Server) ListenAndServe(network, address string) error {
+	if network == "unix" {
+		if err := os.Remove(address); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	l, err := net.Listen(network, address)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Serve accepts the connections of l until Close is called, when it returns ServerClosed
+func (s *Server) Serve(l net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		_ = l.Close()
+		return ServerClosed
+	}
+	s.listeners[l] = true
+	s.mu.Unlock()
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			delete(s.listeners, l)
+			s.mu.Unlock()
+			if closed {
+				return ServerClosed
+			}
+			return err
+		}
+		go s.ServeConn(c)
+	}
+}
+
+// ServeConn serves the requests of a single connection until the client quits or Close is
+//  called, and then closes it
+func (s *Server) ServeConn(c net.Conn) {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		_ = c.Close()
+		return
+	}
+	s.conns[c] = true
+	s.wg.Add(1)
+	s.mu.Unlock()
+	s.stats.connections.Add(1)
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, c)
+		s.mu.Unlock()
+		_ = c.Close()
+		s.wg.Done()
+	}()
+	cn := &conn{
+		s:      s,
+		bucket: s.options.Bucket,
+		r:      bufio.NewReader(c),
+		w:      bufio.NewWriter(c),
+	}
+	if s.options.BucketOf != nil {
+		cn.bucket = s.options.BucketOf(c)
+	}
+	for {
+		quit, err := cn.serve()
+		if err != nil {
+			return
+		}
+		// replies of pipelined requests are sent together
+		if quit || cn.r.Buffered() == 0 {
+			if err := cn.w.Flush(); err != nil || quit {
+				return
+			}
+		}
+	}
+}
+
+// Close stops the listeners and closes the connections, waiting for their requests to complete.
+//  Delayed flush_all commands not run yet are cancelled.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return ServerClosed
+	}
+	s.closed = true
+	var errs []error
+	for l := range s.listeners {
+		errs = append(errs, l.Close())
+	}
+	for c := range s.conns {
+		_ = c.Close()
+	}
+	for t := range s.flushes {
+		t.Stop()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+	return errors.Join(errs...)
+}
+
+// flushAfter flushes bucket b after d unless the server is closed first
+func (s *Server) flushAfter(b *jac.Bucket, d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	var t *time.Timer
+	t = time.AfterFunc(d, func() {
+		s.mu.Lock()
+		delete(s.flushes, t)
+		closed := s.closed
+		s.mu.Unlock()
+		if !closed {
+			b.Flush()
+		}
+	})
+	s.flushes[t] = true
+}
+
+// connections returns the number of open connections
+func (s *Server) connections() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.conns)
+}
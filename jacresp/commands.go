@@ -0,0 +1,485 @@
+package jacresp
+
+import (
+	"bufio"
+	"errors"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fpessolano/jac"
+)
+
+// conn is the state of a client connection
+type conn struct {
+	s  *Server
+	r  *bufio.Reader
+	w  *writer
+	db int
+}
+
+// command runs a request whose number of arguments (name included) has been checked
+type command struct {
+	run   func(c *conn, args []string)
+	arity int // minimum number of arguments, negative when it is also the exact number
+}
+
+var commands = map[string]command{
+	"PING":   {(*conn).ping, 1},
+	"ECHO":   {(*conn).echo, -2},
+	"HELLO":  {(*conn).hello, 1},
+	"SELECT": {(*conn).selectDB, -2},
+	"GET":    {(*conn).get, -2},
+	"SET":    {(*conn).set, 3},
+	"DEL":    {(*conn).del, 2},
+	"EXPIRE": {(*conn).expire, -3},
+	"TTL":    {(*conn).ttl, -2},
+	"INCR":   {(*conn).incr, -2},
+	"MGET":   {(*conn).mget, 2},
+	"MSET":   {(*conn).mset, 3},
+	"SCAN":   {(*conn).scan, 2},
+	"KEYS":   {(*conn).keys, -2},
+}
+
+// execute runs a request, it returns true when the client quits
+func (c *conn) execute(args []string) bool {
+	name := strings.ToUpper(args[0])
+	if name == "QUIT" {
+		c.w.simple("OK")
+		return true
+	}
+	cmd, found := commands[name]
+	switch {
+	case !found:
+		c.w.error("ERR unknown command '" + args[0] + "'")
+	case (cmd.arity < 0 && len(args) != -cmd.arity) || len(args) < cmd.arity:
+		c.w.error("ERR wrong number of arguments for '" + strings.ToLower(args[0]) + "' command")
+	default:
+		cmd.run(c, args)
+	}
+	return false
+}
+
+func (c *conn) ping(args []string) {
+	switch len(args) {
+	case 1:
+		c.w.simple("PONG")
+	case 2:
+		c.w.bulk(args[1])
+	default:
+		c.w.error("ERR wrong number of arguments for 'ping' command")
+	}
+}
+
+func (c *conn) echo(args []string) {
+	c.w.bulk(args[1])
+}
+
+// hello switches the protocol version, authentication and client names are not supported
+func (c *conn) hello(args []string) {
+	if len(args) > 1 {
+		v, err := strconv.Atoi(args[1])
+		if err != nil {
+			c.w.error("ERR Protocol version is not an integer or out of range")
+			return
+		}
+		if v != 2 && v != 3 {
+			c.w.error("NOPROTO unsupported protocol version")
+			return
+		}
+		if len(args) > 2 {
+			c.w.error("ERR syntax error")
+			return
+		}
+		c.w.proto = v
+	}
+	c.w.dict(4)
+	c.w.bulk("server")
+	c.w.bulk("jac")
+	c.w.bulk("proto")
+	c.w.integer(int64(c.w.proto))
+	c.w.bulk("mode")
+	c.w.bulk("standalone")
+	c.w.bulk("role")
+	c.w.bulk("master")
+}
+
+func (c *conn) selectDB(args []string) {
+	db, err := strconv.Atoi(args[1])
+	if err != nil || db < 0 || db >= max(len(c.s.databases), 1) {
+		c.w.error("ERR DB index is out of range")
+		return
+	}
+	c.db = db
+	c.w.simple("OK")
+}
+
+func (c *conn) get(args []string) {
+	b, k, ok := c.route(args[1])
+	if !ok {
+		return
+	}
+	if v, found := b.Get(k); found {
+		c.w.bulk(v)
+		return
+	}
+	c.w.null()
+}
+
+// set supports the EX, PX, NX and XX options
+func (c *conn) set(args []string) {
+	ttl := jac.NoExpiration
+	var nx, xx bool
+	for i := 3; i < len(args); i++ {
+		switch opt := strings.ToUpper(args[i]); {
+		case opt == "NX" && !xx:
+			nx = true
+		case opt == "XX" && !nx:
+			xx = true
+		case (opt == "EX" || opt == "PX") && ttl == jac.NoExpiration && i+1 < len(args):
+			i++
+			n, err := strconv.ParseInt(args[i], 10, 64)
+			if err != nil {
+				c.w.error("ERR value is not an integer or out of range")
+				return
+			}
+			unit := time.Second
+			if opt == "PX" {
+				unit = time.Millisecond
+			}
+			if n <= 0 || n > math.MaxInt64/int64(unit) {
+				c.w.error("ERR invalid expire time in 'set' command")
+				return
+			}
+			ttl = time.Duration(n) * unit
+		default:
+			c.w.error("ERR syntax error")
+			return
+		}
+	}
+	b, k, ok := c.route(args[1])
+	if !ok {
+		return
+	}
+	v := args[2]
+	switch {
+	case nx:
+		// version 0 is only matched by a missing key
+		if _, ok := b.CompareAndSwap(k, 0, v, ttl, !c.s.volatile); !ok {
+			c.w.null()
+			return
+		}
+	case xx:
+		for {
+			_, version, found := b.GetWithVersion(k)
+			if !found {
+				c.w.null()
+				return
+			}
+			if _, ok := b.CompareAndSwap(k, version, v, ttl, !c.s.volatile); ok {
+				break
+			}
+		}
+	default:
+		if err := b.SetE(k, v, ttl, !c.s.volatile); err != nil {
+			c.reply(err)
+			return
+		}
+	}
+	c.w.simple("OK")
+}
+
+func (c *conn) del(args []string) {
+	_, _, groups, ok := c.routeAll(args[1:])
+	if !ok {
+		return
+	}
+	var n int64
+	for b, keys := range groups {
+		for _, found := range b.DeleteMany(keys) {
+			if found {
+				n++
+			}
+		}
+	}
+	c.w.integer(n)
+}
+
+// expire sets the time to live in seconds, a time not in the future deleting the key
+func (c *conn) expire(args []string) {
+	seconds, err := strconv.ParseInt(args[2], 10, 64)
+	if err != nil || seconds > math.MaxInt64/int64(time.Second) {
+		c.w.error("ERR value is not an integer or out of range")
+		return
+	}
+	b, k, ok := c.route(args[1])
+	if !ok {
+		return
+	}
+	var done bool
+	if seconds <= 0 {
+		done = b.DeleteMany([]string{k})[k]
+	} else {
+		done = b.Touch(k, time.Duration(seconds)*time.Second)
+	}
+	c.boolean(done)
+}
+
+// ttl returns the time to live in seconds, -1 for keys without expiration and -2 for missing keys
+func (c *conn) ttl(args []string) {
+	b, k, ok := c.route(args[1])
+	if !ok {
+		return
+	}
+	d, found := b.TTL(k)
+	switch {
+	case !found:
+		c.w.integer(-2)
+	case d == jac.NoExpiration:
+		c.w.integer(-1)
+	default:
+		c.w.integer(int64(d.Round(time.Second) / time.Second))
+	}
+}
+
+func (c *conn) incr(args []string) {
+	b, k, ok := c.route(args[1])
+	if !ok {
+		return
+	}
+	n, err := b.Increment(k, 1, jac.NoExpiration, !c.s.volatile)
+	if errors.Is(err, jac.NotNumeric) {
+		c.w.error("ERR value is not an integer or out of range")
+		return
+	}
+	if errors.Is(err, jac.Overflow) {
+		c.w.error("ERR increment or decrement would overflow")
+		return
+	}
+	if err != nil {
+		c.reply(err)
+		return
+	}
+	c.w.integer(n)
+}
+
+func (c *conn) mget(args []string) {
+	buckets, keys, groups, ok := c.routeAll(args[1:])
+	if !ok {
+		return
+	}
+	values := make(map[*jac.Bucket]map[string]string, len(groups))
+	for b, group := range groups {
+		values[b] = b.GetMany(group)
+	}
+	c.w.array(len(keys))
+	for i, k := range keys {
+		if v, found := values[buckets[i]][k]; found {
+			c.w.bulk(v)
+		} else {
+			c.w.null()
+		}
+	}
+}
+
+func (c *conn) mset(args []string) {
+	if len(args)%2 == 0 {
+		c.w.error("ERR wrong number of arguments for 'mset' command")
+		return
+	}
+	items := make(map[*jac.Bucket]map[string]interface{})
+	for i := 1; i < len(args); i += 2 {
+		b, k, ok := c.route(args[i])
+		if !ok {
+			return
+		}
+		if items[b] == nil {
+			items[b] = make(map[string]interface{})
+		}
+		items[b][k] = args[i+1]
+	}
+	var failed error
+	for b, group := range items {
+		for _, err := range b.SetMany(group, jac.NoExpiration, !c.s.volatile) {
+			if err != nil {
+				failed = err
+			}
+		}
+	}
+	if failed != nil {
+		c.reply(failed)
+		return
+	}
+	c.w.simple("OK")
+}
+
+// scan pages through the keys of the selected database in key order. Cursors stand for the last
+// key returned, kept by the server for the latest maxCursors pages. COUNT is the number of keys
+// visited, MATCH and TYPE filter them.
+func (c *conn) scan(args []string) {
+	id, err := strconv.ParseUint(args[1], 10, 64)
+	if err != nil {
+		c.w.error("ERR invalid cursor")
+		return
+	}
+	var last string
+	if id != 0 {
+		var found bool
+		if last, found = c.s.cursors.load(id); !found {
+			c.w.error("ERR invalid cursor")
+			return
+		}
+	}
+	pattern, count, all := "*", 10, true
+	for i := 2; i < len(args); i += 2 {
+		if i+1 == len(args) {
+			c.w.error("ERR syntax error")
+			return
+		}
+		switch strings.ToUpper(args[i]) {
+		case "MATCH":
+			pattern = args[i+1]
+			if _, err := jac.Match(pattern, ""); err != nil {
+				c.w.error("ERR invalid pattern")
+				return
+			}
+		case "COUNT":
+			if count, err = strconv.Atoi(args[i+1]); err != nil || count < 1 {
+				c.w.error("ERR value is not an integer or out of range")
+				return
+			}
+		case "TYPE":
+			// all values are strings
+			all = strings.EqualFold(args[i+1], "string")
+		default:
+			c.w.error("ERR syntax error")
+			return
+		}
+	}
+	var page []string
+	more := false
+	for _, m := range c.s.mountsOf(c.db) {
+		cursor, visited := after(m.prefix, last)
+		if visited {
+			continue
+		}
+		b, ok := c.bucket(m.bucket)
+		if !ok {
+			return
+		}
+		pairs, next := b.ScanPage("", cursor, count)
+		for _, p := range pairs {
+			page = append(page, m.prefix+p.Key)
+		}
+		more = more || next != ""
+	}
+	sort.Strings(page)
+	if len(page) > count {
+		page, more = page[:count], true
+	}
+	var next uint64
+	if more {
+		next = c.s.cursors.save(page[len(page)-1])
+	}
+	var keys []string
+	for _, k := range page {
+		if matched, _ := jac.Match(pattern, k); matched && all {
+			keys = append(keys, k)
+		}
+	}
+	c.w.array(2)
+	c.w.bulk(strconv.FormatUint(next, 10))
+	c.w.array(len(keys))
+	for _, k := range keys {
+		c.w.bulk(k)
+	}
+}
+
+// after returns the cursor within the bucket mounted at prefix following key last, or true when
+// all its keys sort before last
+func after(prefix, last string) (string, bool) {
+	switch {
+	case last == "" || last < prefix:
+		return "", false
+	case strings.HasPrefix(last, prefix):
+		return last[len(prefix):], false
+	}
+	return "", true
+}
+
+func (c *conn) keys(args []string) {
+	pattern := args[1]
+	if _, err := jac.Match(pattern, ""); err != nil {
+		c.w.error("ERR invalid pattern")
+		return
+	}
+	var keys []string
+	for _, m := range c.s.mountsOf(c.db) {
+		b, ok := c.bucket(m.bucket)
+		if !ok {
+			return
+		}
+		b.ForEach(func(k, _ string) bool {
+			if matched, _ := jac.Match(pattern, m.prefix+k); matched {
+				keys = append(keys, m.prefix+k)
+			}
+			return true
+		})
+	}
+	sort.Strings(keys)
+	c.w.array(len(keys))
+	for _, k := range keys {
+		c.w.bulk(k)
+	}
+}
+
+// route returns the bucket and bucket key of k, replying with an error when it has none
+func (c *conn) route(k string) (*jac.Bucket, string, bool) {
+	b, key, err := c.s.route(c.db, k)
+	if err != nil {
+		c.w.error(err.Error())
+		return nil, "", false
+	}
+	return b, key, true
+}
+
+// routeAll routes several keys, returning the bucket and bucket key of each and the keys grouped
+// by bucket so that each bucket is accessed once
+func (c *conn) routeAll(args []string) ([]*jac.Bucket, []string, map[*jac.Bucket][]string, bool) {
+	buckets := make([]*jac.Bucket, len(args))
+	keys := make([]string, len(args))
+	groups := make(map[*jac.Bucket][]string)
+	for i, k := range args {
+		b, key, ok := c.route(k)
+		if !ok {
+			return nil, nil, nil, false
+		}
+		buckets[i], keys[i] = b, key
+		groups[b] = append(groups[b], key)
+	}
+	return buckets, keys, groups, true
+}
+
+func (c *conn) bucket(name string) (*jac.Bucket, bool) {
+	b, err := c.s.bucket(name)
+	if err != nil {
+		c.w.error(err.Error())
+		return nil, false
+	}
+	return b, true
+}
+
+func (c *conn) boolean(b bool) {
+	if b {
+		c.w.integer(1)
+		return
+	}
+	c.w.integer(0)
+}
+
+// reply sends the error of a bucket method
+func (c *conn) reply(err error) {
+	c.w.error("ERR " + err.Error())
+}
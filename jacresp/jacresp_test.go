@@ -0,0 +1,269 @@
+package jacresp
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fpessolano/jac"
+)
+
+// client is a minimal RESP client, replies are decoded into strings, int64, nil and []interface{}
+type client struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func dial(t *testing.T, network, address string) *client {
+	t.Helper()
+	conn, err := net.Dial(network, address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	return &client{t: t, conn: conn, r: bufio.NewReader(conn)}
+}
+
+func (c *client) do(args ...string) interface{} {
+	c.t.Helper()
+	req := "*" + strconv.Itoa(len(args)) + "\r\n"
+	for _, a := range args {
+		req += "$" + strconv.Itoa(len(a)) + "\r\n" + a + "\r\n"
+	}
+	if _, err := c.conn.Write([]byte(req)); err != nil {
+		c.t.Fatal(err)
+	}
+	return c.read()
+}
+
+func (c *client) read() interface{} {
+	c.t.Helper()
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	switch line[0] {
+	case '+':
+		return line[1:]
+	case '-':
+		return fmt.Errorf("%s", line[1:])
+	case ':':
+		n, _ := strconv.ParseInt(line[1:], 10, 64)
+		return n
+	case '_':
+		return nil
+	case '$':
+		n, _ := strconv.Atoi(line[1:])
+		if n < 0 {
+			return nil
+		}
+		b := make([]byte, n+2)
+		if _, err := io.ReadFull(c.r, b); err != nil {
+			c.t.Fatal(err)
+		}
+		return string(b[:n])
+	case '*', '%':
+		n, _ := strconv.Atoi(line[1:])
+		if line[0] == '%' {
+			n *= 2
+		}
+		if n < 0 {
+			return nil
+		}
+		a := make([]interface{}, n)
+		for i := range a {
+			a[i] = c.read()
+		}
+		return a
+	}
+	c.t.Fatalf("unexpected reply %q", line)
+	return nil
+}
+
+func newTestServer(t *testing.T) (*jac.Cache, *Server) {
+	folder := t.TempDir()
+	cache, err := jac.New(&jac.Options{WorkingFolder: folder, RecoveryFolder: folder})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = cache.Terminate() })
+	for _, name := range []string{"db0", "db1", "sessions"} {
+		if _, err := cache.NewBucket(name, jac.NoExpiration); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s, err := New(cache, &Options{Databases: []string{"db0", "db1"}, Prefixes: map[string]string{"session:": "sessions"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cache, s
+}
+
+func Test_commands(t *testing.T) {
+	cache, s := newTestServer(t)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error)
+	go func() { done <- s.Serve(l) }()
+	c := dial(t, "tcp", l.Addr().String())
+
+	for _, step := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"PING"}, "PONG"},
+		{[]string{"SET", "a", "1"}, "OK"},
+		{[]string{"GET", "a"}, "1"},
+		{[]string{"SET", "a", "2", "NX"}, "<nil>"},
+		{[]string{"SET", "b", "2", "XX"}, "<nil>"},
+		{[]string{"SET", "a", "2", "XX", "EX", "100"}, "OK"},
+		{[]string{"TTL", "a"}, "100"},
+		{[]string{"SET", "b", "x", "NX", "PX", "100000"}, "OK"},
+		{[]string{"SET", "b", "x", "EX", "0"}, "ERR invalid expire time in 'set' command"},
+		{[]string{"SET", "b", "x", "NX", "XX"}, "ERR syntax error"},
+		{[]string{"TTL", "missing"}, "-2"},
+		{[]string{"EXPIRE", "b", "10"}, "1"},
+		{[]string{"TTL", "b"}, "10"},
+		{[]string{"EXPIRE", "missing", "10"}, "0"},
+		{[]string{"INCR", "n"}, "1"},
+		{[]string{"INCR", "n"}, "2"},
+		{[]string{"TTL", "n"}, "-1"},
+		{[]string{"INCR", "b"}, "ERR value is not an integer or out of range"},
+		{[]string{"SET", "max", "9223372036854775807"}, "OK"},
+		{[]string{"INCR", "max"}, "ERR increment or decrement would overflow"},
+		{[]string{"GET", "max"}, "9223372036854775807"},
+		{[]string{"DEL", "max"}, "1"},
+		{[]string{"MSET", "c", "3", "session:x", "alice"}, "OK"},
+		{[]string{"MGET", "a", "missing", "session:x"}, "[2 <nil> alice]"},
+		{[]string{"KEYS", "*"}, "[a b c n session:x]"},
+		{[]string{"KEYS", "[ab]"}, "[a b]"},
+		{[]string{"DEL", "a", "session:x", "missing"}, "2"},
+		{[]string{"EXPIRE", "b", "0"}, "1"},
+		{[]string{"GET", "b"}, "<nil>"},
+		{[]string{"SELECT", "1"}, "OK"},
+		{[]string{"GET", "c"}, "<nil>"},
+		{[]string{"SELECT", "2"}, "ERR DB index is out of range"},
+		{[]string{"GET"}, "ERR wrong number of arguments for 'get' command"},
+		{[]string{"FLUSHALL"}, "ERR unknown command 'FLUSHALL'"},
+	} {
+		if got := fmt.Sprint(c.do(step.args...)); got != step.want {
+			t.Errorf("%v returned %v instead of %v", step.args, got, step.want)
+		}
+	}
+	if v, _ := cache.Bucket("sessions"); v.ItemCount() != 0 {
+		t.Errorf("prefixed key not deleted from its bucket")
+	}
+	if v, found := mustBucket(t, cache, "db0").Get("c"); !found || v != "3" {
+		t.Errorf("key not written in the database bucket: %v", v)
+	}
+
+	// RESP3 nulls and maps
+	if hello := c.do("HELLO", "3"); fmt.Sprint(hello) != "[server jac proto 3 mode standalone role master]" {
+		t.Errorf("HELLO returned %v", hello)
+	}
+	if line := c.raw("GET", "missing"); line != "_\r\n" {
+		t.Errorf("RESP3 null %q", line)
+	}
+
+	// null and empty arrays are ignored
+	if _, err := c.conn.Write([]byte("*-1\r\n*0\r\n*-2147483648\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	if pong := c.do("PING"); pong != "PONG" {
+		t.Errorf("PING after empty arrays returned %v", pong)
+	}
+
+	// inline commands and pipelining
+	if _, err := c.conn.Write([]byte("PING\r\nPING hello\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	if a, b := c.read(), c.read(); a != "PONG" || b != "hello" {
+		t.Errorf("pipelined replies %v %v", a, b)
+	}
+
+	if err := s.Close(); err != nil {
+		t.Error(err)
+	}
+	if err := <-done; err != ServerClosed {
+		t.Errorf("Serve returned %v", err)
+	}
+}
+
+// raw sends a request and returns the first line of its reply
+func (c *client) raw(args ...string) string {
+	c.t.Helper()
+	if _, err := c.conn.Write([]byte(strings.Join(args, " ") + "\r\n")); err != nil {
+		c.t.Fatal(err)
+	}
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return line
+}
+
+func mustBucket(t *testing.T, cache *jac.Cache, name string) *jac.Bucket {
+	t.Helper()
+	b, found := cache.Bucket(name)
+	if !found {
+		t.Fatalf("bucket %v not open", name)
+	}
+	return b
+}
+
+func Test_scan(t *testing.T) {
+	cache, s := newTestServer(t)
+	for i := 0; i < 25; i++ {
+		mustBucket(t, cache, "db0").Set(fmt.Sprintf("k%02d", i), i, jac.NoExpiration, false)
+		mustBucket(t, cache, "sessions").Set(fmt.Sprintf("%02d", i), i, jac.NoExpiration, false)
+	}
+	socket := filepath.Join(t.TempDir(), "jac.sock")
+	go func() { _ = s.ListenAndServe("unix", socket) }()
+	defer s.Close()
+	var c *client
+	for i := 0; c == nil; i++ {
+		if conn, err := net.Dial("unix", socket); err == nil {
+			_ = conn.Close()
+			c = dial(t, "unix", socket)
+		} else if i == 100 {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	seen := map[string]bool{}
+	cursor, pages := "0", 0
+	for {
+		reply, ok := c.do("SCAN", cursor, "COUNT", "7").([]interface{})
+		if !ok {
+			t.Fatalf("SCAN returned %v", reply)
+		}
+		for _, k := range reply[1].([]interface{}) {
+			seen[k.(string)] = true
+		}
+		pages++
+		if cursor = reply[0].(string); cursor == "0" {
+			break
+		}
+	}
+	if len(seen) != 50 || !seen["k00"] || !seen["session:24"] || pages != 8 {
+		t.Errorf("%d keys in %d pages", len(seen), pages)
+	}
+	reply := c.do("SCAN", "0", "MATCH", "session:1*", "COUNT", "100").([]interface{})
+	if fmt.Sprint(reply) != "[0 [session:10 session:11 session:12 session:13 session:14 session:15 session:16 session:17 session:18 session:19]]" {
+		t.Errorf("SCAN MATCH returned %v", reply)
+	}
+	if err, ok := c.do("SCAN", "12345").(error); !ok || err.Error() != "ERR invalid cursor" {
+		t.Errorf("unknown cursor accepted: %v", err)
+	}
+}
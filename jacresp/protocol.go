@@ -0,0 +1,137 @@
+package jacresp
+
+import (
+	"bufio"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// limits of a request, larger ones close the connection
+const (
+	maxArgs      = 1 << 20
+	maxBulkBytes = 64 << 20
+	maxInline    = 64 << 10
+)
+
+// protocolError is a malformed request, reported to the client before closing the connection
+type protocolError string
+
+func (e protocolError) Error() string {
+	return "Protocol error: " + string(e)
+}
+
+// readCommand reads a request: an array of bulk strings or an inline command (for telnet).
+// Empty inline lines and arrays return no arguments.
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 || line[0] != '*' {
+		return strings.Fields(line), nil
+	}
+	n, err := strconv.Atoi(line[1:])
+	if err != nil || n > maxArgs {
+		return nil, protocolError("invalid multibulk length")
+	}
+	if n <= 0 {
+		// null and empty arrays are ignored, as by Redis
+		return nil, nil
+	}
+	args := make([]string, 0, min(n, 1024))
+	for i := 0; i < n; i++ {
+		if line, err = readLine(r); err != nil {
+			return nil, err
+		}
+		if len(line) == 0 || line[0] != '$' {
+			return nil, protocolError("expected '$', got '" + line + "'")
+		}
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < 0 || size > maxBulkBytes {
+			return nil, protocolError("invalid bulk length")
+		}
+		b := make([]byte, size+2)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		if b[size] != '\r' || b[size+1] != '\n' {
+			return nil, protocolError("bulk string not terminated by CRLF")
+		}
+		args = append(args, string(b[:size]))
+	}
+	return args, nil
+}
+
+// readLine reads a line terminated by CRLF (or LF for inline commands) without its terminator
+func readLine(r *bufio.Reader) (string, error) {
+	var line []byte
+	for {
+		part, isPrefix, err := r.ReadLine()
+		if err != nil {
+			return "", err
+		}
+		line = append(line, part...)
+		if len(line) > maxInline {
+			return "", protocolError("too big request")
+		}
+		if !isPrefix {
+			return string(line), nil
+		}
+	}
+}
+
+// writer encodes replies in RESP2, or RESP3 once the client has switched with HELLO 3
+type writer struct {
+	*bufio.Writer
+	proto int
+}
+
+func (w *writer) simple(s string) {
+	w.WriteByte('+')
+	w.WriteString(s)
+	w.WriteString("\r\n")
+}
+
+func (w *writer) error(msg string) {
+	w.WriteByte('-')
+	w.WriteString(msg)
+	w.WriteString("\r\n")
+}
+
+func (w *writer) integer(n int64) {
+	w.header(':', n)
+}
+
+func (w *writer) bulk(s string) {
+	w.header('$', int64(len(s)))
+	w.WriteString(s)
+	w.WriteString("\r\n")
+}
+
+func (w *writer) null() {
+	if w.proto == 3 {
+		w.WriteString("_\r\n")
+		return
+	}
+	w.WriteString("$-1\r\n")
+}
+
+func (w *writer) array(n int) {
+	w.header('*', int64(n))
+}
+
+// dict starts a map of n pairs, sent as an array of 2n elements in RESP2
+func (w *writer) dict(n int) {
+	if w.proto == 3 {
+		w.header('%', int64(n))
+		return
+	}
+	w.header('*', int64(2*n))
+}
+
+func (w *writer) header(kind byte, n int64) {
+	w.WriteByte(kind)
+	w.WriteString(strconv.FormatInt(n, 10))
+	w.WriteString("\r\n")
+}
@@ -0,0 +1,250 @@
+// Package jacresp serves the buckets of a jac cache to Redis clients, speaking RESP2 and RESP3
+// (after HELLO 3) over TCP or Unix sockets.
+//
+// Every database index is mapped to a bucket, and key prefixes can be mapped to buckets of
+// their own. The supported commands are GET, SET (with EX, PX, NX and XX), DEL, EXPIRE, TTL,
+// INCR, MGET, MSET, SCAN and KEYS, together with PING, ECHO, HELLO, SELECT and QUIT.
+package jacresp
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/fpessolano/jac"
+)
+
+var (
+	ServerClosed = errors.New("server closed")
+	NoBuckets    = errors.New("no database or prefix mapped to a bucket")
+)
+
+// Options are the settings of a server
+type Options struct {
+	// Names of the buckets of databases 0, 1, ... SELECT rejects other indexes
+	Databases []string
+	// Names of the buckets of the keys starting with a prefix, which is not part of the key in the
+	// bucket. Prefixes apply to all databases and take precedence over them, the longest matching first
+	Prefixes map[string]string
+	// Writes are kept in memory only instead of being recorded in the working files
+	Volatile bool
+}
+
+// Server answers the requests of Redis clients with the buckets of a cache
+type Server struct {
+	cache     *jac.Cache
+	databases []string
+	mounts    []mount // sorted by decreasing prefix length
+	volatile  bool
+	cursors   cursors
+	mu        sync.Mutex
+	listeners map[net.Listener]bool
+	conns     map[net.Conn]bool
+	closed    bool
+	wg        sync.WaitGroup
+}
+
+// mount is a bucket holding the keys starting with prefix, without it
+type mount struct {
+	prefix string
+	bucket string
+}
+
+// New returns a server for the buckets of cache c. The buckets are looked up by name for every
+//  request, so they can be opened and closed while the server is running.
+func New(c *jac.Cache, o *Options) (*Server, error) {
+	if o == nil || (len(o.Databases) == 0 && len(o.Prefixes) == 0) {
+		return nil, NoBuckets
+	}
+	s := &Server{
+		cache:     c,
+		databases: o.Databases,
+		volatile:  o.Volatile,
+		listeners: make(map[net.Listener]bool),
+		conns:     make(map[net.Conn]bool),
+	}
+	for prefix, bucket := range o.Prefixes {
+		if prefix == "" {
+			return nil, jac.IllegalParameter
+		}
+		s.mounts = append(s.mounts, mount{prefix, bucket})
+	}
+	sort.Slice(s.mounts, func(i, j int) bool {
+		return len(s.mounts[i].prefix) > len(s.mounts[j].prefix)
+	})
+	s.cursors.keys = make(map[uint64]string)
+	return s, nil
+}
+
+// ListenAndServe listens on a TCP address ("tcp") or Unix socket path ("unix") and serves the
+//  connections until Close is called, when it returns ServerClosed. An existing Unix socket file
+//  is replaced.
+func (s *Server) ListenAndServe(network, address string) error {
+	if network == "unix" {
+		if err := os.Remove(address); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	l, err := net.Listen(network, address)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Serve accepts the connections of l until Close is called, when it returns ServerClosed
+func (s *Server) Serve(l net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		_ = l.Close()
+		return ServerClosed
+	}
+	s.listeners[l] = true
+	s.mu.Unlock()
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			delete(s.listeners, l)
+			s.mu.Unlock()
+			if closed {
+				return ServerClosed
+			}
+			return err
+		}
+		go s.ServeConn(c)
+	}
+}
+
+// ServeConn serves the requests of a single connection until the client quits or Close is
+//  called, and then closes it
+func (s *Server) ServeConn(c net.Conn) {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		_ = c.Close()
+		return
+	}
+	s.conns[c] = true
+	s.wg.Add(1)
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, c)
+		s.mu.Unlock()
+		_ = c.Close()
+		s.wg.Done()
+	}()
+	cn := &conn{
+		s: s,
+		r: bufio.NewReader(c),
+		w: &writer{Writer: bufio.NewWriter(c), proto: 2},
+	}
+	for {
+		args, err := readCommand(cn.r)
+		if err != nil {
+			var pe protocolError
+			if errors.As(err, &pe) {
+				cn.w.error("ERR " + pe.Error())
+				_ = cn.w.Flush()
+			}
+			return
+		}
+		quit := len(args) > 0 && cn.execute(args)
+		// replies of pipelined requests are sent together
+		if quit || cn.r.Buffered() == 0 {
+			if err := cn.w.Flush(); err != nil || quit {
+				return
+			}
+		}
+	}
+}
+
+// Close stops the listeners and closes the connections, waiting for their requests to complete
+func (s *Server) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return ServerClosed
+	}
+	s.closed = true
+	var errs []error
+	for l := range s.listeners {
+		errs = append(errs, l.Close())
+	}
+	for c := range s.conns {
+		_ = c.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+	return errors.Join(errs...)
+}
+
+// route returns the bucket of key k in database db and the key within the bucket
+func (s *Server) route(db int, k string) (*jac.Bucket, string, error) {
+	for _, m := range s.mounts {
+		if strings.HasPrefix(k, m.prefix) {
+			b, err := s.bucket(m.bucket)
+			return b, k[len(m.prefix):], err
+		}
+	}
+	if db >= len(s.databases) {
+		return nil, "", errors.New("ERR no bucket for key '" + k + "'")
+	}
+	b, err := s.bucket(s.databases[db])
+	return b, k, err
+}
+
+// mountsOf returns the buckets visible from database db: the prefixed ones and the database one
+func (s *Server) mountsOf(db int) []mount {
+	mounts := s.mounts
+	if db < len(s.databases) {
+		mounts = append(mounts[:len(mounts):len(mounts)], mount{"", s.databases[db]})
+	}
+	return mounts
+}
+
+func (s *Server) bucket(name string) (*jac.Bucket, error) {
+	b, found := s.cache.Bucket(name)
+	if !found {
+		return nil, errors.New("ERR bucket '" + name + "' not open")
+	}
+	return b, nil
+}
+
+// maximum number of SCAN cursors kept, the oldest being forgotten
+const maxCursors = 4096
+
+// cursors maps the numeric SCAN cursors given to clients to the last key returned
+type cursors struct {
+	mu    sync.Mutex
+	last  uint64
+	keys  map[uint64]string
+	order []uint64
+}
+
+func (c *cursors) save(key string) uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.last++
+	c.keys[c.last] = key
+	c.order = append(c.order, c.last)
+	if len(c.order) > maxCursors {
+		delete(c.keys, c.order[0])
+		c.order = c.order[1:]
+	}
+	return c.last
+}
+
+func (c *cursors) load(id uint64) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key, found := c.keys[id]
+	return key, found
+}
@@ -0,0 +1,144 @@
+package jac
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Loader returns the value of a key missing from a bucket and the expiration time to store it with
+type Loader func(ctx context.Context) (value interface{}, t time.Duration, err error)
+
+// loadGroup collapses concurrent loads of the same key and remembers loader errors
+type loadGroup struct {
+	mu       sync.Mutex
+	calls    map[string]*loadCall
+	failures map[string]loadFailure
+	negative time.Duration // BucketOptions.NegativeTTL
+}
+
+type loadCall struct {
+	done  chan struct{} // closed once value and err are set
+	value string
+	err   error
+}
+
+type loadFailure struct {
+	err   error
+	until int64
+}
+
+func newLoadGroup(negative time.Duration) *loadGroup {
+	return &loadGroup{
+		calls:    make(map[string]*loadCall),
+		failures: make(map[string]loadFailure),
+		negative: negative,
+	}
+}
+
+// GetOrLoad returns the value of k, calling loader to obtain and store it when k is missing or expired.
+//  Concurrent calls for the same key share a single loader call, which is not cancelled when ctx is:
+//  ctx only stops the wait and is passed to loader without its cancellation.
+//  With BucketOptions.StaleFor an expired value is returned while it is reloaded in the background,
+//  with BucketOptions.NegativeTTL a loader error is returned again for that long without calling loader.
+//  Loaded values are persistent.
+func (c *Bucket) GetOrLoad(ctx context.Context, k string, loader Loader) (string, error) {
+	if k == "" || loader == nil {
+		return "", IllegalParameter
+	}
+	s := c.bucket.shard(k)
+	s.mu.RLock()
+	item, found := s.items[k]
+	if found {
+		s.access(k)
+	}
+	s.mu.RUnlock()
+	now := time.Now().UnixNano()
+	if found && !item.expiredAt(now) {
+		return fmt.Sprintf("%v", item.Object), nil
+	}
+	if found && !item.expiredAt(now-int64(c.bucket.stale)) {
+		if c.loads.failure(k, now) == nil {
+			c.loads.start(ctx, c, k, loader)
+		}
+		return fmt.Sprintf("%v", item.Object), nil
+	}
+	if err := c.loads.failure(k, now); err != nil {
+		return "", err
+	}
+	call := c.loads.start(ctx, c, k, loader)
+	select {
+	case <-call.done:
+		return call.value, call.err
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+// failure returns the remembered loader error of k, if any
+func (g *loadGroup) failure(k string, now int64) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	f, found := g.failures[k]
+	if !found {
+		return nil
+	}
+	if now > f.until {
+		delete(g.failures, k)
+		return nil
+	}
+	return f.err
+}
+
+// start returns the running load of k, starting one if there is none
+func (g *loadGroup) start(ctx context.Context, c *Bucket, k string, loader Loader) *loadCall {
+	g.mu.Lock()
+	if call, found := g.calls[k]; found {
+		g.mu.Unlock()
+		return call
+	}
+	call := &loadCall{done: make(chan struct{})}
+	g.calls[k] = call
+	g.mu.Unlock()
+	go g.load(context.WithoutCancel(ctx), c, k, loader, call)
+	return call
+}
+
+func (g *loadGroup) load(ctx context.Context, c *Bucket, k string, loader Loader, call *loadCall) {
+	defer close(call.done)
+	defer func() {
+		if r := recover(); r != nil {
+			call.err = fmt.Errorf("%w: %v", LoaderPanic, r)
+		}
+		g.finish(k, call.err)
+	}()
+	v, t, err := loader(ctx)
+	if err == nil && v == nil {
+		err = IllegalParameter
+	}
+	if err != nil {
+		call.err = err
+		return
+	}
+	call.value = anything2String(v)
+	c.Set(k, call.value, t, true)
+}
+
+// finish removes a completed load and remembers its error for NegativeTTL
+func (g *loadGroup) finish(k string, err error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	delete(g.calls, k)
+	if err == nil || g.negative <= 0 {
+		delete(g.failures, k)
+		return
+	}
+	now := time.Now().UnixNano()
+	for key, f := range g.failures {
+		if now > f.until {
+			delete(g.failures, key)
+		}
+	}
+	g.failures[k] = loadFailure{err: err, until: now + int64(g.negative)}
+}
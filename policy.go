@@ -0,0 +1,524 @@
+package jac
+
+import (
+	"container/list"
+	"hash/maphash"
+	"sync"
+)
+
+// EvictionPolicy chooses which items are evicted from a bucket that exceeds its limits.
+// Access can be called concurrently by readers, implementations must be safe for concurrent use.
+type EvictionPolicy interface {
+	Add(k string)           // k has been written, either as a new key or as an update
+	Access(k string)        // k has been read
+	Remove(k string)        // k has been removed from the bucket
+	Victim() (string, bool) // next key to evict, which the policy must no longer consider resident
+	Reset()                 // all keys have been removed
+}
+
+// PolicyFactory returns a new eviction policy for a bucket holding up to capacity items.
+// capacity is BucketOptions.MaxItems, it is 0 when only MaxBytes is given.
+type PolicyFactory func(capacity int) EvictionPolicy
+
+// capacity assumed by the policies that need one when the bucket has no MaxItems
+const defaultPolicyCapacity = 1024
+
+// NewLRU returns a policy evicting the least recently used key
+func NewLRU(int) EvictionPolicy {
+	return newLRUPolicy()
+}
+
+// lruPolicy evicts the least recently used key
+type lruPolicy struct {
+	mu    sync.Mutex
+	order *list.List // most recently used first
+	keys  map[string]*list.Element
+}
+
+func newLRUPolicy() *lruPolicy {
+	return &lruPolicy{
+		order: list.New(),
+		keys:  make(map[string]*list.Element),
+	}
+}
+
+func (p *lruPolicy) Add(k string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if e, found := p.keys[k]; found {
+		p.order.MoveToFront(e)
+		return
+	}
+	p.keys[k] = p.order.PushFront(k)
+}
+
+func (p *lruPolicy) Access(k string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if e, found := p.keys[k]; found {
+		p.order.MoveToFront(e)
+	}
+}
+
+func (p *lruPolicy) Remove(k string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if e, found := p.keys[k]; found {
+		p.order.Remove(e)
+		delete(p.keys, k)
+	}
+}
+
+func (p *lruPolicy) Victim() (string, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	e := p.order.Back()
+	if e == nil {
+		return "", false
+	}
+	k := p.order.Remove(e).(string)
+	delete(p.keys, k)
+	return k, true
+}
+
+func (p *lruPolicy) Reset() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.order.Init()
+	p.keys = make(map[string]*list.Element)
+}
+
+// NewLFU returns a policy evicting the least frequently used key, the least recently used
+// one among keys with the same frequency. All operations are O(1).
+func NewLFU(int) EvictionPolicy {
+	return &lfuPolicy{
+		freqs: list.New(),
+		keys:  make(map[string]*lfuEntry),
+	}
+}
+
+type lfuPolicy struct {
+	mu    sync.Mutex
+	freqs *list.List // of *lfuFrequency, lowest frequency first
+	keys  map[string]*lfuEntry
+}
+
+type lfuFrequency struct {
+	count int
+	keys  *list.List // most recently used first
+}
+
+type lfuEntry struct {
+	freq *list.Element // in lfuPolicy.freqs
+	key  *list.Element // in lfuFrequency.keys
+}
+
+func (p *lfuPolicy) Add(k string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if e, found := p.keys[k]; found {
+		p.increment(k, e)
+		return
+	}
+	front := p.freqs.Front()
+	if front == nil || front.Value.(*lfuFrequency).count != 1 {
+		front = p.freqs.PushFront(&lfuFrequency{count: 1, keys: list.New()})
+	}
+	p.keys[k] = &lfuEntry{
+		freq: front,
+		key:  front.Value.(*lfuFrequency).keys.PushFront(k),
+	}
+}
+
+func (p *lfuPolicy) Access(k string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if e, found := p.keys[k]; found {
+		p.increment(k, e)
+	}
+}
+
+// increment moves k to the next frequency. p.mu must be held.
+func (p *lfuPolicy) increment(k string, e *lfuEntry) {
+	current := e.freq.Value.(*lfuFrequency)
+	next := e.freq.Next()
+	if next == nil || next.Value.(*lfuFrequency).count != current.count+1 {
+		next = p.freqs.InsertAfter(&lfuFrequency{count: current.count + 1, keys: list.New()}, e.freq)
+	}
+	current.keys.Remove(e.key)
+	if current.keys.Len() == 0 {
+		p.freqs.Remove(e.freq)
+	}
+	e.freq = next
+	e.key = next.Value.(*lfuFrequency).keys.PushFront(k)
+}
+
+func (p *lfuPolicy) Remove(k string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.remove(k)
+}
+
+// remove forgets k. p.mu must be held.
+func (p *lfuPolicy) remove(k string) {
+	e, found := p.keys[k]
+	if !found {
+		return
+	}
+	freq := e.freq.Value.(*lfuFrequency)
+	freq.keys.Remove(e.key)
+	if freq.keys.Len() == 0 {
+		p.freqs.Remove(e.freq)
+	}
+	delete(p.keys, k)
+}
+
+func (p *lfuPolicy) Victim() (string, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	front := p.freqs.Front()
+	if front == nil {
+		return "", false
+	}
+	k := front.Value.(*lfuFrequency).keys.Back().Value.(string)
+	p.remove(k)
+	return k, true
+}
+
+func (p *lfuPolicy) Reset() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.freqs.Init()
+	p.keys = make(map[string]*lfuEntry)
+}
+
+// NewARC returns an Adaptive Replacement Cache policy. It balances recency and frequency
+// by keeping the history of recently evicted keys, up to capacity keys for each.
+func NewARC(capacity int) EvictionPolicy {
+	if capacity <= 0 {
+		capacity = defaultPolicyCapacity
+	}
+	return &arcPolicy{
+		capacity: capacity,
+		t1:       newKeyList(),
+		t2:       newKeyList(),
+		b1:       newKeyList(),
+		b2:       newKeyList(),
+	}
+}
+
+type arcPolicy struct {
+	mu       sync.Mutex
+	capacity int
+	p        int      // target size of t1
+	t1, t2   *keyList // resident keys seen once and at least twice
+	b1, b2   *keyList // keys recently evicted from t1 and t2
+}
+
+func (p *arcPolicy) Add(k string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	switch {
+	case p.t1.has(k) || p.t2.has(k):
+		p.hit(k)
+	case p.b1.has(k):
+		// recency history hit: favour t1
+		p.p = min(p.capacity, p.p+max(p.b2.len()/p.b1.len(), 1))
+		p.b1.remove(k)
+		p.t2.pushFront(k)
+	case p.b2.has(k):
+		// frequency history hit: favour t2
+		p.p = max(0, p.p-max(p.b1.len()/p.b2.len(), 1))
+		p.b2.remove(k)
+		p.t2.pushFront(k)
+	default:
+		p.t1.pushFront(k)
+	}
+}
+
+func (p *arcPolicy) Access(k string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.hit(k)
+}
+
+// hit moves a resident key to the front of t2. p.mu must be held.
+func (p *arcPolicy) hit(k string) {
+	if p.t1.remove(k) || p.t2.remove(k) {
+		p.t2.pushFront(k)
+	}
+}
+
+func (p *arcPolicy) Remove(k string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.t1.remove(k) {
+		p.t2.remove(k)
+	}
+}
+
+func (p *arcPolicy) Victim() (string, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var k string
+	switch {
+	case p.t1.len() > 0 && (p.t1.len() > p.p || p.t2.len() == 0):
+		k = p.t1.popBack()
+		p.b1.pushFront(k)
+	case p.t2.len() > 0:
+		k = p.t2.popBack()
+		p.b2.pushFront(k)
+	default:
+		return "", false
+	}
+	for p.b1.len() > p.capacity {
+		p.b1.popBack()
+	}
+	for p.b2.len() > p.capacity {
+		p.b2.popBack()
+	}
+	return k, true
+}
+
+func (p *arcPolicy) Reset() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.p = 0
+	for _, l := range []*keyList{p.t1, p.t2, p.b1, p.b2} {
+		l.reset()
+	}
+}
+
+// NewTinyLFU returns a W-TinyLFU policy: new keys enter a small LRU window and are admitted
+// to the main segmented LRU only if their estimated frequency is higher than the one of the
+// main victim. Frequencies are estimated by a count-min sketch that is aged periodically.
+func NewTinyLFU(capacity int) EvictionPolicy {
+	if capacity <= 0 {
+		capacity = defaultPolicyCapacity
+	}
+	window := max(capacity/100, 1)
+	protected := max((capacity-window)*8/10, 1)
+	return &tinyLFUPolicy{
+		windowCap:    window,
+		mainCap:      max(capacity-window, 1),
+		protectedCap: protected,
+		window:       newKeyList(),
+		probation:    newKeyList(),
+		protected:    newKeyList(),
+		sketch:       newSketch(capacity),
+	}
+}
+
+type tinyLFUPolicy struct {
+	mu           sync.Mutex
+	windowCap    int
+	mainCap      int
+	protectedCap int
+	window       *keyList // admission window, LRU
+	probation    *keyList // main segment for keys seen once since admission
+	protected    *keyList // main segment for keys accessed again
+	sketch       *sketch
+}
+
+func (p *tinyLFUPolicy) Add(k string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.sketch.increment(k)
+	if !p.hit(k) {
+		p.window.pushFront(k)
+		// while the main segments are not full the window overflows into them
+		for p.window.len() > p.windowCap && p.probation.len()+p.protected.len() < p.mainCap {
+			p.probation.pushFront(p.window.popBack())
+		}
+	}
+}
+
+func (p *tinyLFUPolicy) Access(k string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.sketch.increment(k)
+	p.hit(k)
+}
+
+// hit updates the position of a resident key, it returns false if k is not resident.
+// p.mu must be held.
+func (p *tinyLFUPolicy) hit(k string) bool {
+	switch {
+	case p.window.remove(k):
+		p.window.pushFront(k)
+	case p.probation.remove(k):
+		p.protected.pushFront(k)
+		if p.protected.len() > p.protectedCap {
+			p.probation.pushFront(p.protected.popBack())
+		}
+	case p.protected.remove(k):
+		p.protected.pushFront(k)
+	default:
+		return false
+	}
+	return true
+}
+
+func (p *tinyLFUPolicy) Remove(k string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	_ = p.window.remove(k) || p.probation.remove(k) || p.protected.remove(k)
+}
+
+func (p *tinyLFUPolicy) Victim() (string, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	main := p.probation
+	if main.len() == 0 {
+		main = p.protected
+	}
+	if p.window.len() > p.windowCap || main.len() == 0 {
+		if p.window.len() == 0 {
+			return "", false
+		}
+		// the window candidate competes with the main victim for admission
+		candidate := p.window.popBack()
+		if main.len() == 0 {
+			return candidate, true
+		}
+		if p.sketch.estimate(candidate) > p.sketch.estimate(main.back()) {
+			victim := main.popBack()
+			p.probation.pushFront(candidate)
+			return victim, true
+		}
+		return candidate, true
+	}
+	return main.popBack(), true
+}
+
+func (p *tinyLFUPolicy) Reset() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, l := range []*keyList{p.window, p.probation, p.protected} {
+		l.reset()
+	}
+	p.sketch.reset()
+}
+
+// sketch is a count-min sketch with 4 rows of 4 bit counters (stored in bytes), halved every
+// 10 * capacity increments so that old popularity fades away
+type sketch struct {
+	seed    maphash.Seed
+	rows    [4][]uint8
+	shift   uint // 64 - log2 of the row width
+	added   int
+	resetAt int
+}
+
+func newSketch(capacity int) *sketch {
+	width, shift := 16, uint(60)
+	for width < capacity {
+		width <<= 1
+		shift--
+	}
+	s := &sketch{
+		seed:    maphash.MakeSeed(),
+		shift:   shift,
+		resetAt: 10 * capacity,
+	}
+	for i := range s.rows {
+		s.rows[i] = make([]uint8, width)
+	}
+	return s
+}
+
+// odd multipliers mixing the hash of a key differently for every row of a sketch
+var sketchMixers = [4]uint64{0x9e3779b97f4a7c15, 0xbf58476d1ce4e5b9, 0x94d049bb133111eb, 0xd6e8feb86659fd93}
+
+// index returns the counter of h in a row, taken from the high bits of h mixed for that row
+// so that rows stay independent whatever the width
+func (s *sketch) index(h uint64, row int) uint64 {
+	return (h * sketchMixers[row]) >> s.shift
+}
+
+func (s *sketch) increment(k string) {
+	h := maphash.String(s.seed, k)
+	for i := range s.rows {
+		if c := &s.rows[i][s.index(h, i)]; *c < 15 {
+			*c++
+		}
+	}
+	if s.added++; s.added >= s.resetAt {
+		s.age()
+	}
+}
+
+func (s *sketch) estimate(k string) uint8 {
+	h := maphash.String(s.seed, k)
+	m := uint8(15)
+	for i := range s.rows {
+		m = min(m, s.rows[i][s.index(h, i)])
+	}
+	return m
+}
+
+func (s *sketch) age() {
+	for i := range s.rows {
+		for j := range s.rows[i] {
+			s.rows[i][j] >>= 1
+		}
+	}
+	s.added /= 2
+}
+
+func (s *sketch) reset() {
+	for i := range s.rows {
+		clear(s.rows[i])
+	}
+	s.added = 0
+}
+
+// keyList is an LRU ordered set of keys, most recent first
+type keyList struct {
+	order *list.List
+	keys  map[string]*list.Element
+}
+
+func newKeyList() *keyList {
+	return &keyList{
+		order: list.New(),
+		keys:  make(map[string]*list.Element),
+	}
+}
+
+func (l *keyList) len() int {
+	return l.order.Len()
+}
+
+func (l *keyList) has(k string) bool {
+	_, found := l.keys[k]
+	return found
+}
+
+func (l *keyList) pushFront(k string) {
+	l.keys[k] = l.order.PushFront(k)
+}
+
+func (l *keyList) back() string {
+	return l.order.Back().Value.(string)
+}
+
+func (l *keyList) popBack() string {
+	k := l.order.Remove(l.order.Back()).(string)
+	delete(l.keys, k)
+	return k
+}
+
+func (l *keyList) remove(k string) bool {
+	e, found := l.keys[k]
+	if found {
+		l.order.Remove(e)
+		delete(l.keys, k)
+	}
+	return found
+}
+
+func (l *keyList) reset() {
+	l.order.Init()
+	l.keys = make(map[string]*list.Element)
+}
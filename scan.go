@@ -0,0 +1,235 @@
+package jac
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+// KeyValue is a key/value pair returned by the ordered scans
+type KeyValue struct {
+	Key   string
+	Value string
+}
+
+// Scan returns the key/value pairs whose key starts with prefix, sorted by key
+func (c *Bucket) Scan(prefix string) []KeyValue {
+	page, _ := c.ScanPage(prefix, "", 0)
+	return page
+}
+
+// ScanPage returns up to limit key/value pairs whose key starts with prefix and follows cursor,
+//  sorted by key, and the cursor of the next page, empty for the last page. An empty cursor starts
+//  from the first key, limit 0 returns all the pairs.
+func (c *Bucket) ScanPage(prefix, cursor string, limit int) (page []KeyValue, next string) {
+	start := prefix
+	if cursor != "" && cursor+"\x00" > start {
+		// the smallest key after cursor
+		start = cursor + "\x00"
+	}
+	c.bucket.rlock()
+	defer c.bucket.runlock()
+	c.bucket.ascend(start, func(k string, item Item) bool {
+		if !strings.HasPrefix(k, prefix) {
+			return false
+		}
+		if limit > 0 && len(page) == limit {
+			next = page[limit-1].Key
+			return false
+		}
+		page = append(page, KeyValue{k, fmt.Sprintf("%v", item.Object)})
+		return true
+	})
+	return page, next
+}
+
+// Range returns the key/value pairs with a key from start (included) to end (excluded), sorted
+//  by key. An empty end returns all the pairs from start.
+func (c *Bucket) Range(start, end string) (pairs []KeyValue) {
+	c.bucket.rlock()
+	defer c.bucket.runlock()
+	c.bucket.ascend(start, func(k string, item Item) bool {
+		if end != "" && k >= end {
+			return false
+		}
+		pairs = append(pairs, KeyValue{k, fmt.Sprintf("%v", item.Object)})
+		return true
+	})
+	return pairs
+}
+
+// Keys returns the sorted keys matching a glob pattern: * matches any sequence of characters,
+//  ? any character, [abc] and [a-z] a character of a set ([^abc] or [!abc] one that is not) and
+//  \ escapes the following character. It returns IllegalParameter for a malformed pattern.
+func (c *Bucket) Keys(pattern string) (keys []string, err error) {
+	p := []rune(pattern)
+	if err = validGlob(p); err != nil {
+		return nil, err
+	}
+	// only the keys starting with the literal part of the pattern are visited
+	prefix := pattern
+	if i := strings.IndexAny(pattern, `*?[\`); i >= 0 {
+		prefix = pattern[:i]
+	}
+	c.bucket.rlock()
+	defer c.bucket.runlock()
+	c.bucket.ascend(prefix, func(k string, _ Item) bool {
+		if !strings.HasPrefix(k, prefix) {
+			return false
+		}
+		if matchGlob(p, []rune(k)) {
+			keys = append(keys, k)
+		}
+		return true
+	})
+	return keys, nil
+}
+
+// Match reports whether s matches a glob pattern as used by Keys. It returns IllegalParameter
+//  for a malformed pattern.
+func Match(pattern, s string) (bool, error) {
+	p := []rune(pattern)
+	if err := validGlob(p); err != nil {
+		return false, err
+	}
+	return matchGlob(p, []rune(s)), nil
+}
+
+// ascend calls f in key order for the items that have not expired with a key not lower than
+// start, until f returns false. Without index the keys are sorted first. All shards must be read locked.
+func (c *bucketInternal) ascend(start string, f func(k string, item Item) bool) {
+	now := time.Now().UnixNano()
+	live := func(item Item) bool {
+		return !item.expiredAt(now)
+	}
+	if c.index != nil {
+		for n := c.index.seek(start); n != nil; n = n.next[0] {
+			if item, found := c.shard(n.key).items[n.key]; found && live(item) && !f(n.key, item) {
+				return
+			}
+		}
+		return
+	}
+	var keys []string
+	for _, s := range c.shards {
+		for k, item := range s.items {
+			if k >= start && live(item) {
+				keys = append(keys, k)
+			}
+		}
+	}
+	slices.Sort(keys)
+	for _, k := range keys {
+		if !f(k, c.shard(k).items[k]) {
+			return
+		}
+	}
+}
+
+// validGlob checks the character sets and escapes of a pattern
+func validGlob(p []rune) error {
+	for i := 0; i < len(p); i++ {
+		switch p[i] {
+		case '\\':
+			if i++; i == len(p) {
+				return IllegalParameter
+			}
+		case '[':
+			_, n, ok := matchSet(p[i:], 0)
+			if !ok {
+				return IllegalParameter
+			}
+			i += n - 1
+		}
+	}
+	return nil
+}
+
+// matchGlob matches s against a valid pattern p, backtracking to the last * on a mismatch
+func matchGlob(p, s []rune) bool {
+	px, sx := 0, 0
+	starPx, starSx := -1, 0
+	for px < len(p) || sx < len(s) {
+		if px < len(p) {
+			switch p[px] {
+			case '*':
+				starPx, starSx = px, sx
+				px++
+				continue
+			case '?':
+				if sx < len(s) {
+					px++
+					sx++
+					continue
+				}
+			case '[':
+				if sx < len(s) {
+					if matched, n, _ := matchSet(p[px:], s[sx]); matched {
+						px += n
+						sx++
+						continue
+					}
+				}
+			case '\\':
+				if sx < len(s) && p[px+1] == s[sx] {
+					px += 2
+					sx++
+					continue
+				}
+			default:
+				if sx < len(s) && p[px] == s[sx] {
+					px++
+					sx++
+					continue
+				}
+			}
+		}
+		if starPx >= 0 && starSx < len(s) {
+			// let the last * match one more character
+			starSx++
+			px, sx = starPx+1, starSx
+			continue
+		}
+		return false
+	}
+	return true
+}
+
+// matchSet matches r against the set at the start of p and returns the length of the set,
+// ok is false if the set is malformed
+func matchSet(p []rune, r rune) (matched bool, n int, ok bool) {
+	i := 1
+	negated := i < len(p) && (p[i] == '^' || p[i] == '!')
+	if negated {
+		i++
+	}
+	for first := true; i < len(p); first = false {
+		if p[i] == ']' && !first {
+			return matched != negated, i + 1, true
+		}
+		lo := p[i]
+		if lo == '\\' {
+			if i++; i == len(p) {
+				return false, 0, false
+			}
+			lo = p[i]
+		}
+		hi := lo
+		if i+2 < len(p) && p[i+1] == '-' && p[i+2] != ']' {
+			if hi = p[i+2]; hi == '\\' {
+				if i+3 == len(p) {
+					return false, 0, false
+				}
+				hi = p[i+3]
+				i++
+			}
+			i += 2
+		}
+		if lo <= r && r <= hi {
+			matched = true
+		}
+		i++
+	}
+	return false, 0, false
+}
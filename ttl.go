@@ -0,0 +1,68 @@
+package jac
+
+import (
+	"fmt"
+	"time"
+)
+
+// Touch sets the expiration time of k to d from now, the value and its version are unchanged.
+//  It returns false if k is missing. The change is recorded in the working file.
+func (c *Bucket) Touch(k string, d time.Duration) bool {
+	return c.expire(k, c.bucket.expiration(d))
+}
+
+// Persist removes the expiration time of k, it returns false if k is missing.
+//  The change is recorded in the working file.
+func (c *Bucket) Persist(k string) bool {
+	return c.expire(k, 0)
+}
+
+// ExpireAt sets the expiration time of k to t, it returns false if k is missing.
+//  A time that is not in the future, the zero time among them, deletes k as expired.
+//  The change is recorded in the working file.
+func (c *Bucket) ExpireAt(k string, t time.Time) bool {
+	if !t.After(time.Now()) {
+		// UnixNano is undefined for the zero time and 0 means no expiration: any past time deletes k
+		return c.expire(k, 1)
+	}
+	return c.expire(k, t.UnixNano())
+}
+
+// TTL returns the time left before k expires, NoExpiration if it does not expire.
+//  It returns false if k is missing.
+func (c *Bucket) TTL(k string) (time.Duration, bool) {
+	s := c.bucket.shard(k)
+	s.mu.RLock()
+	item, found := s.items[k]
+	s.mu.RUnlock()
+	if !found || item.expired() {
+		return 0, false
+	}
+	if item.Expiration == 0 {
+		return NoExpiration, true
+	}
+	return time.Until(time.Unix(0, item.Expiration)), true
+}
+
+// expire changes the expiration time of an existing key to e (0 for none), a time that is not in
+// the future deletes it
+func (c *Bucket) expire(k string, e int64) bool {
+	s := c.bucket.shard(k)
+	s.mu.Lock()
+	defer s.unlock()
+	item, found := s.items[k]
+	now := time.Now().UnixNano()
+	if !found || item.expiredAt(now) {
+		return false
+	}
+	if e != 0 && e <= now {
+		s.remove(k, EventExpire)
+		c.journal(opDelete, k, "", 0, 0)
+		return true
+	}
+	item.Expiration = e
+	s.items[k] = item
+	// the record carries the value, the set record of the key being skipped if it has expired
+	c.journal(opExpire, k, fmt.Sprintf("%v", item.Object), e, item.Version)
+	return true
+}
@@ -0,0 +1,103 @@
+package jac
+
+import (
+	"fmt"
+	"time"
+)
+
+// Tx gives access to a bucket within Txn, it must not be used once Txn has returned
+type Tx struct {
+	c      *Bucket
+	writes map[string]txWrite
+	order  []string // keys in the order of their first write
+}
+
+type txWrite struct {
+	deleted    bool
+	value      string
+	expiration int64
+}
+
+// Txn runs f with the bucket locked. The writes and deletions made through tx are applied when f
+//  returns nil and discarded when it returns an error, which is then returned by Txn.
+//  Applied changes are recorded in the working file as a single commit record: after a crash either
+//  all or none of them are recovered. Txn returns RecordDropped if the record could not be passed
+//  to the working file writer within LoadDelayMs, in which case the changes are applied in memory only.
+//  f must not call other methods of the bucket.
+func (c *Bucket) Txn(f func(tx *Tx) error) error {
+	tx := &Tx{
+		c:      c,
+		writes: make(map[string]txWrite),
+	}
+	c.bucket.lock()
+	defer c.bucket.unlock()
+	if err := f(tx); err != nil {
+		return err
+	}
+	if !tx.commit() {
+		return RecordDropped
+	}
+	return nil
+}
+
+// commit applies the changes and sends the commit record, it returns false if the record was dropped
+func (tx *Tx) commit() bool {
+	c := tx.c
+	record := make([]FileData, 0, len(tx.order))
+	for _, k := range tx.order {
+		w := tx.writes[k]
+		s := c.bucket.shard(k)
+		if w.deleted {
+			s.remove(k, EventDelete)
+			record = append(record, FileData{Op: opDelete, Key: k, Version: c.bucket.version.Load()})
+			continue
+		}
+		item := c.bucket.item(w.value, w.expiration)
+		record = append(record, FileData{Op: opSet, Key: k, Value: w.value, Expiration: w.expiration, Version: item.Version})
+		for _, x := range s.store(k, item) {
+			record = append(record, FileData{Op: opDelete, Key: x, Version: c.bucket.version.Load()})
+		}
+	}
+	if len(record) > 0 && !c.send(backupData{op: opCommit, batch: record}) {
+		c.cache.report(&PersistenceError{Bucket: c.name, Op: opCommit, Err: RecordDropped})
+		return false
+	}
+	return true
+}
+
+// Get reads the value of k, including the changes made in the transaction
+func (tx *Tx) Get(k string) (string, bool) {
+	if w, found := tx.writes[k]; found {
+		return w.value, !w.deleted
+	}
+	v, found := tx.c.bucket.shard(k).get(k)
+	if !found {
+		return "", false
+	}
+	return fmt.Sprintf("%v", v), true
+}
+
+// Set writes a new key/value pair with a given expiration time t when the transaction is committed.
+//  It returns IllegalParameter for an empty key or a nil value.
+func (tx *Tx) Set(k string, vn interface{}, t time.Duration) error {
+	if k == "" || vn == nil {
+		return IllegalParameter
+	}
+	tx.write(k, txWrite{
+		value:      anything2String(vn),
+		expiration: tx.c.bucket.expiration(t),
+	})
+	return nil
+}
+
+// Delete removes k when the transaction is committed
+func (tx *Tx) Delete(k string) {
+	tx.write(k, txWrite{deleted: true})
+}
+
+func (tx *Tx) write(k string, w txWrite) {
+	if _, found := tx.writes[k]; !found {
+		tx.order = append(tx.order, k)
+	}
+	tx.writes[k] = w
+}
@@ -0,0 +1,170 @@
+package jac
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"time"
+)
+
+// Codec converts values of type T to and from the bytes stored in a bucket
+type Codec[T any] interface {
+	Encode(v T) ([]byte, error)
+	Decode(data []byte) (T, error)
+}
+
+// JSONCodec stores values as JSON, keeping the working files readable
+type JSONCodec[T any] struct{}
+
+func (JSONCodec[T]) Encode(v T) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (JSONCodec[T]) Decode(data []byte) (v T, err error) {
+	err = json.Unmarshal(data, &v)
+	return
+}
+
+// GobCodec stores values as gob, which is more compact but not readable
+type GobCodec[T any] struct{}
+
+func (GobCodec[T]) Encode(v T) ([]byte, error) {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(v)
+	return buf.Bytes(), err
+}
+
+func (GobCodec[T]) Decode(data []byte) (v T, err error) {
+	err = gob.NewDecoder(bytes.NewReader(data)).Decode(&v)
+	return
+}
+
+// BytesCodec stores raw bytes unchanged
+type BytesCodec struct{}
+
+func (BytesCodec) Encode(v []byte) ([]byte, error) {
+	return v, nil
+}
+
+func (BytesCodec) Decode(data []byte) ([]byte, error) {
+	return data, nil
+}
+
+// TypedBucket gives access to a bucket with values of type T, encoded with a codec.
+// Values that are not valid UTF-8 are stored in base64 in the working file.
+type TypedBucket[T any] struct {
+	bucket *Bucket
+	codec  Codec[T]
+}
+
+// NewTypedBucket returns a typed view of bucket b using codec to encode and decode values
+func NewTypedBucket[T any](b *Bucket, codec Codec[T]) *TypedBucket[T] {
+	return &TypedBucket[T]{
+		bucket: b,
+		codec:  codec,
+	}
+}
+
+// Bucket returns the underlying bucket
+func (c *TypedBucket[T]) Bucket() *Bucket {
+	return c.bucket
+}
+
+// Get reads the value associated to the key k.
+//  It returns false if the key has not value associated to it and an error if the value
+//  cannot be decoded
+func (c *TypedBucket[T]) Get(k string) (v T, found bool, err error) {
+	s, found := c.bucket.Get(k)
+	if !found {
+		return
+	}
+	v, err = c.codec.Decode([]byte(s))
+	return
+}
+
+// GetWithExpiration performs the same operation as Get but it also returns the
+//  value expiration time
+func (c *TypedBucket[T]) GetWithExpiration(k string) (v T, exp time.Time, found bool, err error) {
+	s, exp, found := c.bucket.GetWithExpiration(k)
+	if !found {
+		return
+	}
+	v, err = c.codec.Decode([]byte(s))
+	return
+}
+
+// GetWithVersion performs the same operation as Get but it also returns the value version
+func (c *TypedBucket[T]) GetWithVersion(k string) (v T, version uint64, found bool, err error) {
+	s, version, found := c.bucket.GetWithVersion(k)
+	if !found {
+		return
+	}
+	v, err = c.codec.Decode([]byte(s))
+	return
+}
+
+// Set writes a new key/value pair with a given expiration time t (see Bucket.SetE)
+func (c *TypedBucket[T]) Set(k string, v T, t time.Duration, pers bool) error {
+	data, err := c.codec.Encode(v)
+	if err != nil {
+		return err
+	}
+	return c.bucket.SetE(k, string(data), t, pers)
+}
+
+// Add adds a new key/value pair only if the key does not already exist (see Bucket.Add).
+//  It returns the existing value and true if the key was already present.
+func (c *TypedBucket[T]) Add(k string, v T, t time.Duration, pers bool) (old T, found bool, err error) {
+	data, err := c.codec.Encode(v)
+	if err != nil {
+		return
+	}
+	s, found := c.bucket.Add(k, string(data), t, pers)
+	if found {
+		old, err = c.codec.Decode([]byte(s))
+	}
+	return
+}
+
+// Replace replaces an existing key/value pair only if it already exists (see Bucket.Replace)
+func (c *TypedBucket[T]) Replace(k string, v T, t time.Duration, pers bool) error {
+	data, err := c.codec.Encode(v)
+	if err != nil {
+		return err
+	}
+	c.bucket.Replace(k, string(data), t, pers)
+	return nil
+}
+
+// CompareAndSwap writes v only if the version of k is still expected (see Bucket.CompareAndSwap)
+func (c *TypedBucket[T]) CompareAndSwap(k string, expected uint64, v T, t time.Duration, pers bool) (uint64, bool, error) {
+	data, err := c.codec.Encode(v)
+	if err != nil {
+		return 0, false, err
+	}
+	version, swapped := c.bucket.CompareAndSwap(k, expected, string(data), t, pers)
+	return version, swapped, nil
+}
+
+// Delete permanently removes an item from the bucket
+func (c *TypedBucket[T]) Delete(k string) {
+	c.bucket.Delete(k)
+}
+
+// Items returns all elements in the bucket. Values that cannot be decoded are skipped and
+//  the first decoding error is returned.
+func (c *TypedBucket[T]) Items() (map[string]T, error) {
+	var err error
+	rt := make(map[string]T)
+	for k, s := range c.bucket.Items() {
+		v, e := c.codec.Decode([]byte(s))
+		if e != nil {
+			if err == nil {
+				err = e
+			}
+			continue
+		}
+		rt[k] = v
+	}
+	return rt, err
+}
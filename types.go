@@ -1,8 +1,10 @@
 package jac
 
 import (
+	"hash/maphash"
 	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -14,31 +16,83 @@ import (
 //	InternalBuffering:  10,
 //	LoadDelayMs:        10,
 //	MaximumAge:         5 * 60,
+//	Durability:         SyncNever,
+//	SyncIntervalMs:     100,
+//	SyncRecords:        100,
 type Options struct {
-	ExpirationTime     int    // Expiration time is seconds
-	IntervalCompacting int    // Cache working files compacting interval in seconds (values smaller than 60s will be defaulted to 60s)
-	InternalBuffering  int    // Buffering length to decouple the in-memory cache from the disk processes. Bigger numbers improve cache speed at expenses of system crash resistance
-	LoadDelayMs        int    // Regulates the start-up delay. Smaller numbers improves start-up time at costs of possible loss of persistence
-	MaximumAge         int64  // Maximum age (in s) of a back-up file (.rec) or working file (.data) for it to be used to initialise the cache
-	WorkingFolder      string // folder for working files (.data). File contain the entire cache in a readable. Altering the files only affects the initial cache load not its operation
-	RecoveryFolder     string // folder for back-up files (.rec)
+	ExpirationTime     int         // Expiration time is seconds
+	IntervalCompacting int         // Cache working files compacting interval in seconds (values smaller than 60s will be defaulted to 60s)
+	InternalBuffering  int         // Buffering length to decouple the in-memory cache from the disk processes. Bigger numbers improve cache speed at expenses of system crash resistance
+	LoadDelayMs        int         // Regulates the start-up delay. Smaller numbers improves start-up time at costs of possible loss of persistence
+	MaximumAge         int64       // Maximum age (in s) of a back-up file (.rec) or working file (.data) for it to be used to initialise the cache
+	WorkingFolder      string      // folder for working files (.data). File contain the entire cache in a readable. Altering the files only affects the initial cache load not its operation
+	RecoveryFolder     string      // folder for back-up files (.rec)
+	Durability         Durability  // When working file records are synced to disk. Stronger modes trade write throughput for resistance to power failures
+	SyncIntervalMs     int         // Sync period in ms for SyncEveryInterval (group commit)
+	SyncRecords        int         // Number of records between syncs for SyncEveryRecords
+	Verbose            bool        // Verbose output (useful for development purposes), used by New only
+	OnError            func(error) // Optional handler for errors that cannot be returned to the caller (see PersistenceError). It must not block
 }
 
+// Durability selects when records written to the working file are synced to disk
+type Durability int
+
 type Item struct {
 	Object     interface{}
 	Expiration int64
+	Version    uint64 // increases with every write in the bucket, 0 in files written before versions were kept
 }
 
 type FileData struct {
-	Key   string `json:"key"`
-	Value string `json:"value"`
+	Op         string     `json:"op,omitempty"` // set, delete, flush, expire (a set changing the expiration time only), batch or commit. Records without it are treated as set
+	Key        string     `json:"key"`
+	Value      string     `json:"value"`
+	Expiration int64      `json:"exp,omitempty"`   // absolute expiration time in Unix nanoseconds, 0 for none
+	Encoding   string     `json:"enc,omitempty"`   // base64 for values that are not valid UTF-8, empty otherwise
+	Version    uint64     `json:"ver,omitempty"`   // version of the item, or last version given in the bucket for op version
+	Batch      []FileData `json:"batch,omitempty"` // records of op batch or commit, written and applied together
+}
+
+// BucketOptions are the optional settings of a bucket
+type BucketOptions struct {
+	MaxItems int           // Maximum number of items, items are evicted beyond it. 0 for no limit
+	MaxBytes int64         // Maximum size of keys and values in bytes, items are evicted beyond it. 0 for no limit
+	Policy   PolicyFactory // Eviction policy used when a limit is given (NewLRU, NewLFU, NewARC, NewTinyLFU). nil for NewLRU
+	Shards   int           // Number of shards with their own lock, limits and policy. 0 for 1
+	Ordered  bool          // Keeps a sorted index of the keys so that Scan, ScanPage, Range and Keys do not sort the bucket
+	// Number of goroutines running the OnEvicted, OnSet and OnExpired callbacks. 0 for 1
+	CallbackWorkers int
+	// GetOrLoad settings
+	StaleFor    time.Duration // Time after expiration during which a value is still served while it is reloaded. 0 for none
+	NegativeTTL time.Duration // Time during which a loader error is returned again instead of calling the loader. 0 for none
+}
+
+// RecoveryReport describes how a bucket was initialised from its files
+type RecoveryReport struct {
+	Source    string // file the bucket was loaded from, empty if none was used
+	Version   int    // working file format version, 0 for files written before versioning
+	Recovered int    // number of records (or keys for a .rec file) loaded
+	Discarded int    // number of records discarded from the first corrupt one onwards
+	Err       error  // reason loading stopped early, nil if the whole file was loaded
+}
+
+// Cache is a set of buckets sharing the same options and working file writer
+type Cache struct {
+	options Options
+	verbose bool
+	writer  chan backupData
+	rst     chan interface{}
+	mu      sync.Mutex
+	buckets map[string]*Bucket // open buckets, nil once the cache has been terminated
 }
 
 type Bucket struct {
 	name   string
+	report RecoveryReport
+	cache  *Cache
 	bucket *bucketInternalPtr
-	file   *os.File
-	writer chan backupData
+	file   *workingFile
+	loads  *loadGroup
 	cr     chan interface{}
 }
 
@@ -49,15 +103,29 @@ type bucketInternalPtr struct {
 
 type bucketInternal struct {
 	defaultExpiration time.Duration
-	items             map[string]Item
-	mu                sync.RWMutex
-	onEvicted         func(string, interface{})
-	janitor           *janitor
+	shards            []*shard
+	seed              maphash.Seed  // selects the shard of a key
+	janitors          []*janitor    // one per shard
+	stale             time.Duration // expired items are kept for BucketOptions.StaleFor
+	version           atomic.Uint64 // last version given to an item
+	index             *skiplist     // sorted keys, nil when the bucket is not ordered
+	watch             *watchers
+	hooks             *hooks // OnEvicted, OnSet and OnExpired
 }
 
-type keyAndValue struct {
-	key   string
-	value interface{}
+// shard holds part of the items of a bucket, keys are spread among shards by their hash
+type shard struct {
+	items       map[string]Item
+	mu          sync.RWMutex
+	size        int64          // bytes used by keys and values
+	maxItems    int            // 0 for no limit
+	maxBytes    int64          // 0 for no limit
+	policy      EvictionPolicy // nil when the bucket has no limits
+	index       *skiplist      // shared by all shards, nil when the bucket is not ordered
+	watch       *watchers      // shared by all shards
+	hooks       *hooks         // shared by all shards
+	pending     []notice       // callbacks to run once mu is released
+	dispatching sync.Mutex     // keeps pending in order while it is dispatched after releasing mu
 }
 
 type janitor struct {
@@ -66,9 +134,26 @@ type janitor struct {
 }
 
 type backupData struct {
-	data [2]string
-	c    *bucketInternalPtr // when not nil a file compaction is requested
-	file *os.File
+	op    string
+	data  [2]string
+	exp   int64
+	ver   uint64
+	batch []FileData         // records of op batch or commit
+	sync  Durability         // overrides Options.Durability when not DefaultDurability
+	done  chan error         // when not nil it receives the outcome once the record has been written
+	c     *bucketInternalPtr // when not nil a file compaction is requested
+	file  *workingFile
+}
+
+type workingFile struct {
+	mu     sync.Mutex
+	bucket string
+	path   string
+	f      *os.File // nil once the bucket has been closed
+	dirt   int      // records written since the last sync
+	// records appended during a compaction, nil when the file is not being compacted
+	during     []FileData
+	compacting sync.WaitGroup
 }
 
 type updateFunc func(k, v string) (string, string)
@@ -9,7 +9,54 @@ const (
 	DefaultExpiration time.Duration = 0
 )
 
-var options Options
-var writeChannel chan backupData
-var writeRstChannel chan interface{}
-var verbose bool
+const (
+	// To use the durability given in Options
+	DefaultDurability Durability = iota
+	// Records are never explicitly synced, the operating system decides when they reach the disk
+	SyncNever
+	// Every record is synced before the next one is written
+	SyncEveryWrite
+	// Records are synced every SyncIntervalMs (group commit)
+	SyncEveryInterval
+	// Records are synced every SyncRecords records
+	SyncEveryRecords
+)
+
+// working file format
+const (
+	dataVersion      = 1
+	dataHeaderPrefix = "#jac data v"
+	dataHeader       = dataHeaderPrefix + "1"
+)
+
+// number of records appended during a compaction under which they are copied with the working
+// file locked, to replace it
+const compactTail = 100
+
+// number of items read from a shard at a time by compaction and iterators, the shard being
+// unlocked in between
+const chunkItems = 1000
+
+// capacity of the callback queue of every worker of a bucket
+const callbackQueue = 256
+
+// encoding of working file values that are not valid UTF-8
+const encodingBase64 = "base64"
+
+// working file operations
+const (
+	opSet    = "set"
+	opDelete = "delete"
+	opFlush  = "flush"
+	opExpire = "expire"
+	opBatch  = "batch"
+	opCommit = "commit"
+	// last version given in the bucket, written at the start of a rewritten working file
+	opVersion = "version"
+	// only used to report errors
+	opSync    = "sync"
+	opCompact = "compact"
+)
+
+// cache used by the package level functions (Initialise, Terminate and NewBucket)
+var defaultCache *Cache
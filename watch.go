@@ -0,0 +1,198 @@
+package jac
+
+import (
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// EventType is the kind of change reported by an Event
+type EventType int
+
+const (
+	// no event, used internally for changes that are not reported (loading a bucket)
+	noEvent EventType = iota
+	// A missing key has been written
+	EventSet
+	// An existing key has been written
+	EventUpdate
+	// A key has been deleted, also by Flush
+	EventDelete
+	// A key has been removed after its expiration time
+	EventExpire
+	// A key has been evicted to respect the bucket limits
+	EventEvict
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventSet:
+		return "set"
+	case EventUpdate:
+		return "update"
+	case EventDelete:
+		return "delete"
+	case EventExpire:
+		return "expire"
+	case EventEvict:
+		return "evict"
+	}
+	return "none"
+}
+
+// Event reports a change of a key. Old is empty for EventSet and New is empty for deletions,
+// expirations and evictions. Version is the version of the new value.
+type Event struct {
+	Type    EventType
+	Key     string
+	Old     string
+	New     string
+	Version uint64
+}
+
+// SlowConsumer selects what happens to the events of a watcher whose buffer is full
+type SlowConsumer int
+
+const (
+	// Events are dropped
+	WatchDrop SlowConsumer = iota
+	// Writers of the bucket wait for the watcher to receive the event
+	WatchBlock
+	// The watcher channel is closed
+	WatchDisconnect
+)
+
+// WatchOptions are the optional settings of a watcher
+type WatchOptions struct {
+	Buffer int          // Events buffered for the watcher, 0 for 64
+	Policy SlowConsumer // What happens when the buffer is full
+}
+
+// Watch returns a channel receiving the changes of the keys starting with prefix, in the order in
+//  which they are made for each key, and a function to stop watching. Events are buffered and dropped
+//  when the buffer is full (see WatchWithOptions). The channel is closed by cancel or when the bucket
+//  is closed.
+func (c *Bucket) Watch(prefix string) (<-chan Event, func()) {
+	return c.WatchWithOptions(prefix, nil)
+}
+
+// WatchWithOptions performs the same operation as Watch with options o, nil for none.
+//  With WatchBlock a full buffer blocks the writers of the bucket, which the consumer must not call
+//  while it is receiving. With WatchDisconnect the channel is closed when the buffer is full.
+func (c *Bucket) WatchWithOptions(prefix string, o *WatchOptions) (<-chan Event, func()) {
+	w := &watcher{
+		prefix: prefix,
+		ch:     make(chan Event, 64),
+		done:   make(chan struct{}),
+	}
+	if o != nil {
+		if o.Buffer > 0 {
+			w.ch = make(chan Event, o.Buffer)
+		}
+		w.policy = o.Policy
+	}
+	c.bucket.watch.add(w)
+	return w.ch, func() {
+		c.bucket.watch.cancel(w)
+	}
+}
+
+// watchers are the watchers of a bucket, shared by all shards
+type watchers struct {
+	mu   sync.RWMutex
+	list []*watcher
+	n    atomic.Int32 // len(list), read without lock to skip building events nobody receives
+}
+
+type watcher struct {
+	prefix string
+	policy SlowConsumer
+	ch     chan Event
+	done   chan struct{} // closed when the watcher is cancelled, unblocks WatchBlock sends
+	once   sync.Once
+	mu     sync.Mutex // serialises sends and close of ch
+	closed bool
+}
+
+func (ws *watchers) active() bool {
+	return ws.n.Load() > 0
+}
+
+func (ws *watchers) add(w *watcher) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	ws.list = append(ws.list, w)
+	ws.n.Store(int32(len(ws.list)))
+}
+
+// cancel closes the channel of a watcher and forgets it
+func (ws *watchers) cancel(w *watcher) {
+	w.once.Do(func() {
+		close(w.done)
+		w.close()
+		ws.mu.Lock()
+		defer ws.mu.Unlock()
+		ws.list = slices.DeleteFunc(ws.list, func(x *watcher) bool { return x == w })
+		ws.n.Store(int32(len(ws.list)))
+	})
+}
+
+// cancelAll cancels all watchers, when the bucket is closed
+func (ws *watchers) cancelAll() {
+	ws.mu.RLock()
+	list := slices.Clone(ws.list)
+	ws.mu.RUnlock()
+	for _, w := range list {
+		ws.cancel(w)
+	}
+}
+
+// publish passes an event to the watchers of its key. It is called with the shard of the key
+// locked so that the events of a key are received in order.
+func (ws *watchers) publish(ev Event) {
+	ws.mu.RLock()
+	defer ws.mu.RUnlock()
+	for _, w := range ws.list {
+		if strings.HasPrefix(ev.Key, w.prefix) && !w.deliver(ev) {
+			// disconnected, it cannot be removed while the list is read
+			go ws.cancel(w)
+		}
+	}
+}
+
+// deliver sends an event according to the watcher policy, it returns false if the watcher
+// has been disconnected
+func (w *watcher) deliver(ev Event) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return true
+	}
+	select {
+	case w.ch <- ev:
+		return true
+	default:
+	}
+	switch w.policy {
+	case WatchBlock:
+		select {
+		case w.ch <- ev:
+		case <-w.done:
+		}
+	case WatchDisconnect:
+		close(w.ch)
+		w.closed = true
+		return false
+	}
+	return true
+}
+
+func (w *watcher) close() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.closed {
+		close(w.ch)
+		w.closed = true
+	}
+}
@@ -0,0 +1,386 @@
+package jac
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// working file (.data) access, shared by all copies of a Bucket and by writeHandler
+
+func newWorkingFile(bucket, path string, c *bucketInternal) (*workingFile, error) {
+	w := &workingFile{bucket: bucket, path: path}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w, w.rewrite(c)
+}
+
+// rewrite atomically replaces the working file with the content of the bucket and
+// reopens it for appending. A crash during the rewrite leaves the previous file intact.
+// w.mu must be held by the caller, which must prevent writes to the bucket meanwhile.
+func (w *workingFile) rewrite(c *bucketInternal) error {
+	err := writeAtomic(w.path, func(f *os.File) error {
+		b := bufio.NewWriter(f)
+		if err := writeSnapshot(b, c); err != nil {
+			return err
+		}
+		return b.Flush()
+	})
+	if err != nil {
+		return err
+	}
+	return w.reopen()
+}
+
+// compact rewrites the working file unless it has been closed, without stopping writes to the
+// bucket or to the file. Records appended to the file meanwhile are kept and appended to the
+// new file, after the state of the bucket they may already be part of: replaying them again
+// leads to the same state. w.mu is only held to write the last few of them and to replace the file.
+func (w *workingFile) compact(c *bucketInternal) error {
+	w.mu.Lock()
+	if w.f == nil || w.during != nil {
+		w.mu.Unlock()
+		return nil
+	}
+	w.during = []FileData{}
+	w.compacting.Add(1)
+	defer w.compacting.Done()
+	w.mu.Unlock()
+	dir := filepath.Dir(w.path)
+	f, err := os.CreateTemp(dir, filepath.Base(w.path)+".*.tmp")
+	if err != nil {
+		w.mu.Lock()
+		w.during = nil
+		w.mu.Unlock()
+		return err
+	}
+	b := bufio.NewWriter(f)
+	err = writeSnapshot(b, c)
+	for err == nil {
+		w.mu.Lock()
+		records := w.during
+		if len(records) < compactTail {
+			w.mu.Unlock()
+			break
+		}
+		w.during = []FileData{}
+		w.mu.Unlock()
+		err = writeRecords(b, records)
+	}
+	if err == nil {
+		err = b.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	w.mu.Lock()
+	records := w.during
+	w.during = nil
+	if err == nil && w.f == nil {
+		err = os.ErrClosed
+	}
+	if err == nil {
+		err = writeRecords(b, records)
+	}
+	if err == nil {
+		err = b.Flush()
+	}
+	if err == nil && len(records) > 0 {
+		err = f.Sync()
+	}
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), w.path)
+	}
+	if err == nil {
+		err = w.reopen()
+	}
+	w.mu.Unlock()
+	if err != nil {
+		_ = os.Remove(f.Name())
+		return err
+	}
+	return syncDir(dir)
+}
+
+// writeSnapshot writes the header of a working file and the items of the bucket to b.
+// The shards are read in chunks of chunkItems, which are written with the shard unlocked.
+// Write errors are kept by b and returned by its Flush.
+func writeSnapshot(b *bufio.Writer, c *bucketInternal) error {
+	_, _ = b.WriteString(dataHeader + "\n")
+	// versions of deleted keys must not be given again after a restart
+	records := []FileData{{Op: opVersion, Version: c.version.Load()}}
+	if err := writeRecords(b, records); err != nil {
+		return err
+	}
+	records = make([]FileData, 0, chunkItems)
+	var err error
+	for _, s := range c.shards {
+		s.chunks(chunkItems, func(k string, v Item) {
+			if value := fmt.Sprintf("%v", v.Object); value != "" {
+				records = append(records, FileData{
+					Op:         opSet,
+					Key:        k,
+					Value:      value,
+					Expiration: v.Expiration,
+					Version:    v.Version,
+				})
+			}
+		}, func() bool {
+			err = writeRecords(b, records)
+			records = records[:0]
+			return err == nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeRecords writes records to b, write errors are returned by its Flush
+func writeRecords(b *bufio.Writer, records []FileData) error {
+	for _, record := range records {
+		data, err := encodeRecord(record)
+		if err != nil {
+			return err
+		}
+		_, _ = b.Write(data)
+	}
+	return nil
+}
+
+// reopen opens the working file for appending after it has been replaced. w.mu must be held.
+func (w *workingFile) reopen() error {
+	f, err := os.OpenFile(w.path, os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		return err
+	}
+	if w.f != nil {
+		_ = w.f.Close()
+	}
+	w.f = f
+	w.dirt = 0
+	return nil
+}
+
+// append writes a record at the end of the working file and syncs it according to mode,
+// every is the number of records between syncs for SyncEveryRecords.
+// It returns true when the file is left with unsynced records that need a periodic sync.
+func (w *workingFile) append(record FileData, mode Durability, every int) (bool, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.f == nil {
+		return false, os.ErrClosed
+	}
+	data, err := encodeRecord(record)
+	if err != nil {
+		return false, err
+	}
+	if _, err = w.f.Write(data); err != nil {
+		return false, err
+	}
+	if w.during != nil {
+		w.during = append(w.during, record)
+	}
+	w.dirt++
+	switch mode {
+	case SyncEveryWrite:
+		return false, w.sync()
+	case SyncEveryRecords:
+		if w.dirt >= every {
+			return false, w.sync()
+		}
+	case SyncEveryInterval:
+		return true, nil
+	}
+	return false, nil
+}
+
+// sync flushes the records written since the last sync to disk. w.mu must be held by the caller.
+func (w *workingFile) sync() error {
+	if w.f == nil || w.dirt == 0 {
+		return nil
+	}
+	w.dirt = 0
+	return w.f.Sync()
+}
+
+// flush is the locking version of sync used for periodic syncs
+func (w *workingFile) flush() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.sync()
+}
+
+func (w *workingFile) close() error {
+	if w == nil {
+		return nil
+	}
+	w.mu.Lock()
+	if w.f == nil {
+		w.mu.Unlock()
+		return nil
+	}
+	err := w.sync()
+	if e := w.f.Close(); err == nil {
+		err = e
+	}
+	w.f = nil
+	w.mu.Unlock()
+	// a compaction in progress stops without replacing the file
+	w.compacting.Wait()
+	return err
+}
+
+func (w *workingFile) closed() bool {
+	if w == nil {
+		return true
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.f == nil
+}
+
+// encodeRecord returns the working file line for a record: its CRC32 as 8 hex digits,
+// a space and the JSON encoding of the record
+func encodeRecord(record FileData) ([]byte, error) {
+	encodeValue(&record)
+	if record.Batch != nil {
+		batch := make([]FileData, len(record.Batch))
+		for i, r := range record.Batch {
+			encodeValue(&r)
+			batch[i] = r
+		}
+		record.Batch = batch
+	}
+	data, err := json.Marshal(record)
+	if err != nil {
+		return nil, err
+	}
+	line := make([]byte, 0, len(data)+10)
+	line = fmt.Appendf(line, "%08x ", crc32.ChecksumIEEE(data))
+	line = append(line, data...)
+	return append(line, '\n'), nil
+}
+
+// decodeRecord parses a working file line written with the given format version
+func decodeRecord(line []byte, version int) (record FileData, err error) {
+	if version > 0 {
+		sum, data, found := bytes.Cut(line, []byte{' '})
+		if !found || len(sum) != 8 {
+			return record, fmt.Errorf("missing checksum")
+		}
+		expected, err := strconv.ParseUint(string(sum), 16, 32)
+		if err != nil {
+			return record, fmt.Errorf("malformed checksum")
+		}
+		if crc32.ChecksumIEEE(data) != uint32(expected) {
+			return record, fmt.Errorf("checksum mismatch")
+		}
+		line = data
+	}
+	if err = json.Unmarshal(line, &record); err != nil {
+		return
+	}
+	if err = decodeValue(&record); err != nil {
+		return
+	}
+	for i := range record.Batch {
+		if err = decodeValue(&record.Batch[i]); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// encodeValue stores values that are not valid UTF-8 in base64, JSON strings cannot hold arbitrary bytes
+func encodeValue(record *FileData) {
+	if !utf8.ValidString(record.Value) {
+		record.Value = base64.StdEncoding.EncodeToString([]byte(record.Value))
+		record.Encoding = encodingBase64
+	}
+}
+
+// decodeValue reverts encodeValue
+func decodeValue(record *FileData) error {
+	if record.Encoding != encodingBase64 {
+		return nil
+	}
+	value, err := base64.StdEncoding.DecodeString(record.Value)
+	if err != nil {
+		return err
+	}
+	record.Value = string(value)
+	record.Encoding = ""
+	return nil
+}
+
+// readWorkingFile applies the records of a working file in order. It stops at the first corrupt
+// record, which is normally a line torn by a crash, and reports what was recovered and discarded.
+// Files without header are read as bare JSON lines (version 0).
+func readWorkingFile(path string, apply func(FileData)) (report RecoveryReport) {
+	report.Source = path
+	f, err := os.Open(path)
+	if err != nil {
+		report.Err = err
+		return
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	for n := 1; ; n++ {
+		line, err := r.ReadBytes('\n')
+		if len(line) == 0 && err != nil {
+			if err != io.EOF {
+				report.Err = err
+			}
+			return
+		}
+		line = bytes.TrimRight(line, "\r\n")
+		if n == 1 && strings.HasPrefix(string(line), dataHeaderPrefix) {
+			if report.Version, err = strconv.Atoi(strings.TrimPrefix(string(line), dataHeaderPrefix)); err != nil || report.Version > dataVersion {
+				report.Err = fmt.Errorf("%w: %q", UnsupportedFormat, line)
+				report.Discarded = countLines(r)
+				return
+			}
+			continue
+		}
+		if len(line) == 0 {
+			continue
+		}
+		record, e := decodeRecord(line, report.Version)
+		if e != nil {
+			report.Err = fmt.Errorf("%w at line %d: %v", CorruptRecord, n, e)
+			report.Discarded = 1 + countLines(r)
+			return
+		}
+		apply(record)
+		if record.Op != opVersion {
+			report.Recovered++
+		}
+	}
+}
+
+// countLines returns the number of non empty lines left in r
+func countLines(r *bufio.Reader) (n int) {
+	for {
+		line, err := r.ReadBytes('\n')
+		if len(bytes.TrimSpace(line)) > 0 {
+			n++
+		}
+		if err != nil {
+			return
+		}
+	}
+}